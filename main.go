@@ -2,26 +2,82 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/huaishan/awsignal/signalsrv"
 )
 
 var addr = flag.String("addr", "0.0.0.0:8000", "http service address")
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1048576,
-	WriteBufferSize: 1048576,
-}
+var lowMemory = flag.Bool("low-memory", false, "share write buffers and avoid idle writer goroutines")
+var netpoll = flag.Bool("netpoll", false, "read idle peers with a single epoll loop (linux, implies -low-memory)")
+var adminAddr = flag.String("admin-addr", "127.0.0.1:8001", "admin http address for metrics and log verbosity, empty to disable")
+var adminToken = flag.String("admin-token", os.Getenv("AWSIGNAL_ADMIN_TOKEN"), "bearer token for the admin api, defaults to $AWSIGNAL_ADMIN_TOKEN")
+var auditLog = flag.String("audit-log", "", "append admin actions as json lines to this file instead of the server log")
+var otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP collector url for traces, e.g. http://127.0.0.1:4318, empty to disable")
+var traceSample = flag.Float64("trace-sample", 1, "share of new traces that are recorded")
+var tracePropagation = flag.Bool("trace-propagation", false, "continue client traces given by the traceparent handshake query parameter")
+var maxPeers = flag.Int("max-peers", 0, "readiness fails at this many peers, 0 to disable")
+var maxGoroutines = flag.Int("max-goroutines", 0, "readiness fails at this many goroutines, 0 to disable")
+var drainDelay = flag.Duration("drain-delay", 0, "time between failing readiness and closing the listener on shutdown")
+var recordDir = flag.String("record-dir", "", "directory for session recordings, empty to disable recording")
+var record = flag.String("record", "", "comma separated apps or app:address scopes to record from the start")
+var recordMaxSize = flag.Int64("record-max-size", 64<<20, "rotate a recording file after this many bytes")
+var recordMaxFiles = flag.Int("record-max-files", 10, "recording files kept per scope")
+var shareRTT = flag.Bool("share-rtt", false, "send the keepalive rtt of peers in shared rooms to the other peers of the room")
+var allowedOrigins = flag.String("allowed-origins", "", "comma separated origins allowed to upgrade, as origin for every app or app=origin, wildcards like https://*.example.com")
+var allowMissingOrigin = flag.Bool("allow-missing-origin", true, "accept clients without an Origin header when -allowed-origins is set")
+var authSecrets = flag.String("auth-secrets", os.Getenv("AWSIGNAL_AUTH_SECRETS"), "comma separated HMAC token secrets as secret or kid:secret, defaults to $AWSIGNAL_AUTH_SECRETS")
+var authJWKS = flag.String("auth-jwks", "", "local JWKS file with the token verification keys, reloaded when it changes")
+var authApps = flag.String("auth-apps", "", "comma separated apps that require a token, empty for all apps if secrets or a JWKS are set")
+var authIssuer = flag.String("auth-issuer", "", "required token issuer")
+var authAudience = flag.String("auth-audience", "", "required token audience")
+var authOptional = flag.Bool("auth-optional", false, "let peers without a token in, bad tokens are still rejected")
+var authListen = flag.String("auth-listen", "", "comma separated address patterns tokens may listen on, e.g. user:{sub}:*, empty for any")
+var authConnect = flag.String("auth-connect", "", "comma separated address patterns tokens may connect to, empty for any")
+var authNoListenRoles = flag.String("auth-no-listen-roles", "", "comma separated token roles that may not listen, e.g. guest")
+var tlsCert = flag.String("tls-cert", "", "certificate file to serve wss:// directly, reloaded when it changes")
+var tlsKey = flag.String("tls-key", "", "private key file of -tls-cert")
+var tlsMinVersion = flag.String("tls-min-version", "1.2", "minimum tls version, 1.0 to 1.3")
+var tlsMaxVersion = flag.String("tls-max-version", "", "maximum tls version, empty for the newest")
+var tlsCiphers = flag.String("tls-ciphers", "", "comma separated tls 1.2 cipher suites, empty for the go defaults")
+var httpRedirectAddr = flag.String("http-redirect-addr", "", "plain http address that redirects to https when -tls-cert is set, e.g. :80")
+var mtlsCA = flag.String("mtls-ca", "", "CA bundle for client certificates, requires -tls-cert")
+var mtlsApps = flag.String("mtls-apps", "", "comma separated apps that accept client certificates, empty for all apps if -mtls-ca is set")
+var mtlsIdentities = flag.String("mtls-identities", "", "json file with a list of client certificate identities: subject, tenant, roles, listen, connect, reserved")
+var mtlsRequired = flag.Bool("mtls-required", false, "reject upgrades to the -mtls-apps without a client certificate")
+var reservedAddresses = flag.String("reserved-addresses", "", "comma separated address patterns only reserved client certificate identities may listen on")
+var limitMsgs = flag.Float64("limit-msgs", 0, "events per second a peer may send, 0 to disable")
+var limitMsgBurst = flag.Int("limit-msg-burst", 0, "events a peer may send at once, 0 for one second of -limit-msgs")
+var limitBytes = flag.Float64("limit-bytes", 0, "event bytes per second a peer may send, 0 to disable")
+var limitByteBurst = flag.Int("limit-byte-burst", 0, "event bytes a peer may send at once, 0 for one second of -limit-bytes")
+var limitAction = flag.String("limit-action", "drop", "what happens to events over the limits, drop, delay or disconnect")
+var limitConnRate = flag.Float64("limit-conn-rate", 0, "upgrade attempts per second of an ip, 0 to disable")
+var limitConnBurst = flag.Int("limit-conn-burst", 0, "upgrade attempts an ip may make at once, 0 for one second of -limit-conn-rate")
+var limitConnsPerIP = flag.Int("limit-conns-per-ip", 0, "concurrent peers of an ip, 0 to disable")
+var limitApps = flag.String("limit-apps", "", "comma separated apps the limits apply to, empty for all apps")
+var banFile = flag.String("ban-file", "", "json file the bans of the admin api are kept in across restarts, empty to keep them in memory")
+var trustedProxies = flag.String("trusted-proxies", "", "comma separated proxy ips or cidrs whose Forwarded or X-Forwarded-For headers name the client")
+var proxyProtocol = flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1 or v2 header on every connection, only from -trusted-proxies if set")
+var knockApps = flag.String("knock-apps", "", "comma separated apps whose listeners accept or reject every connector before it is linked")
+var knockTimeout = flag.Duration("knock-timeout", 30*time.Second, "time a listener of the -knock-apps has to answer a join request")
+var logFormat = flag.String("log-format", "text", "log format, text or json")
+var logLevel = flag.String("log-level", "info", "log level, debug, info, warn or error")
+var logPayloads = flag.Bool("log-payloads", false, "log message payloads of debug level events")
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
 	flag.Parse()
 	apps := []*signalsrv.AppConfig{
 		{Path: "/", AppName: "Test", AddressSharing: false},
@@ -31,6 +87,111 @@ func main() {
 		{Path: "/test", AppName: "UnitTests", AddressSharing: false},
 		{Path: "/testshared", AppName: "UnitTestsAddressSharing", AddressSharing: true},
 	}
+	for _, conf := range apps {
+		conf.ShareRTT = conf.AddressSharing && *shareRTT
+		conf.AllowMissingOrigin = *allowMissingOrigin
+		conf.KnockToJoin = contains(strings.Split(*knockApps, ","), conf.AppName)
+		conf.KnockTimeout = *knockTimeout
+		for _, origin := range strings.Split(*allowedOrigins, ",") {
+			if i := strings.Index(origin, "="); i >= 0 {
+				if origin[:i] != conf.AppName {
+					continue
+				}
+				origin = origin[i+1:]
+			}
+			if origin != "" {
+				conf.AllowedOrigins = append(conf.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	if *authSecrets != "" || *authJWKS != "" {
+		secrets := make(map[string][]byte)
+		for _, secret := range strings.Split(*authSecrets, ",") {
+			if secret == "" {
+				continue
+			}
+			if i := strings.Index(secret, ":"); i >= 0 {
+				secrets[secret[:i]] = []byte(secret[i+1:])
+			} else {
+				secrets[""] = []byte(secret)
+			}
+		}
+		auth, err := signalsrv.NewAuthenticator(signalsrv.AuthConfig{
+			Secrets:  secrets,
+			JWKSFile: *authJWKS,
+			Issuer:   *authIssuer,
+			Audience: *authAudience,
+			Leeway:   30 * time.Second,
+			Optional: *authOptional,
+			Policy: signalsrv.Policy{
+				Listen:        splitList(*authListen),
+				Connect:       splitList(*authConnect),
+				NoListenRoles: splitList(*authNoListenRoles),
+			},
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, conf := range apps {
+			if *authApps == "" || contains(strings.Split(*authApps, ","), conf.AppName) {
+				conf.Auth = auth
+			}
+		}
+	}
+
+	if *mtlsCA != "" && *tlsCert == "" {
+		log.Fatal("-mtls-ca requires -tls-cert")
+	}
+	if *mtlsCA != "" {
+		var identities []signalsrv.CertIdentity
+		if *mtlsIdentities != "" {
+			b, err := ioutil.ReadFile(*mtlsIdentities)
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			if err := json.Unmarshal(b, &identities); err != nil {
+				log.Fatal(err.Error())
+			}
+		}
+		certs, err := signalsrv.NewClientCertAuth(signalsrv.ClientCertConfig{
+			CAFile:     *mtlsCA,
+			Identities: identities,
+			Required:   *mtlsRequired,
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, conf := range apps {
+			if *mtlsApps == "" || contains(strings.Split(*mtlsApps, ","), conf.AppName) {
+				conf.ClientCerts = certs
+			}
+		}
+	}
+	for _, conf := range apps {
+		conf.ReservedAddresses = splitList(*reservedAddresses)
+	}
+
+	switch action := signalsrv.LimitAction(*limitAction); action {
+	case signalsrv.LimitDrop, signalsrv.LimitDelay, signalsrv.LimitDisconnect:
+		limits := &signalsrv.RateLimits{
+			MessagesPerSecond:    *limitMsgs,
+			MessageBurst:         *limitMsgBurst,
+			BytesPerSecond:       *limitBytes,
+			ByteBurst:            *limitByteBurst,
+			Action:               action,
+			ConnectionsPerSecond: *limitConnRate,
+			ConnectionBurst:      *limitConnBurst,
+			MaxConnectionsPerIP:  *limitConnsPerIP,
+		}
+		for _, conf := range apps {
+			if *limitApps == "" || contains(strings.Split(*limitApps, ","), conf.AppName) {
+				conf.Limits = limits
+			}
+		}
+	default:
+		log.Fatalf("unknown -limit-action %q", *limitAction)
+	}
 
 	srv := &http.Server{
 		Addr:         *addr,
@@ -38,33 +199,211 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 	}
 
-	wns := signalsrv.NewWebsocketNetworkServer()
+	level, err := signalsrv.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	verbosity := signalsrv.NewVerbosity(level)
+	verbosity.SetPayloads(*logPayloads)
+	logger := signalsrv.NewTextLogger(os.Stderr)
+	if *logFormat == "json" {
+		logger = signalsrv.NewJSONLogger(os.Stderr)
+	}
+
+	var tracer *signalsrv.Tracer
+	if *otlpEndpoint != "" {
+		tracer = signalsrv.NewTracer(signalsrv.TracerConfig{
+			Endpoint:    *otlpEndpoint,
+			SampleRatio: *traceSample,
+			Logger:      logger,
+		})
+	}
+
+	var recorder *signalsrv.Recorder
+	if *recordDir != "" {
+		recorder, err = signalsrv.NewRecorder(signalsrv.RecorderConfig{
+			Dir:         *recordDir,
+			MaxFileSize: *recordMaxSize,
+			MaxFiles:    *recordMaxFiles,
+			Logger:      logger,
+		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		for _, scope := range strings.Split(*record, ",") {
+			if scope == "" {
+				continue
+			}
+			parts := strings.SplitN(scope, ":", 2)
+			if len(parts) == 1 {
+				recorder.Enable(parts[0], "")
+			} else {
+				recorder.Enable(parts[0], parts[1])
+			}
+		}
+	}
+
+	bans, err := signalsrv.NewBanList(*banFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	proxies, err := signalsrv.ParseCIDRs(splitList(*trustedProxies))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	wns := signalsrv.NewWebsocketNetworkServer(&signalsrv.ServerConfig{
+		ReadBufferSize:   1048576,
+		WriteBufferSize:  1048576,
+		LowMemory:        *lowMemory || *netpoll,
+		Netpoll:          *netpoll,
+		Logger:           logger,
+		Verbosity:        verbosity,
+		Tracer:           tracer,
+		TracePropagation: *tracePropagation,
+		Recorder:         recorder,
+		MaxPeers:         *maxPeers,
+		MaxGoroutines:    *maxGoroutines,
+		Bans:             bans,
+		TrustedProxies:   proxies,
+	})
+	http.Handle("/healthz", wns.Liveness())
+	http.Handle("/readyz", wns.Readiness())
+	http.Handle("/version", signalsrv.VersionHandler())
 	for _, conf := range apps {
+		conf := conf
 		http.HandleFunc(conf.Path, func(w http.ResponseWriter, r *http.Request) {
-			conn, err := upgrader.Upgrade(w, r, nil)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			wns.OnConnection(conn, conf)
+			wns.HandleUpgrade(w, r, conf)
+		})
+	}
+
+	redirectSrv := &http.Server{
+		Addr:         *httpRedirectAddr,
+		Handler:      signalsrv.RedirectHTTPS(*addr),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if *proxyProtocol {
+		ln = signalsrv.NewProxyListener(ln, proxies)
+	}
+	if *tlsCert != "" {
+		srv.TLSConfig, err = signalsrv.NewTLSConfig(signalsrv.TLSOptions{
+			CertFile:           *tlsCert,
+			KeyFile:            *tlsKey,
+			MinVersion:         *tlsMinVersion,
+			MaxVersion:         *tlsMaxVersion,
+			CipherSuites:       splitList(*tlsCiphers),
+			RequestClientCerts: *mtlsCA != "",
+			Logger:             logger,
 		})
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		go func() {
+			if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err.Error())
+			}
+		}()
+		logger.Log(signalsrv.LevelInfo, "websockets/https listening", signalsrv.F("addr", *addr), signalsrv.F("version", signalsrv.Version))
+		if *httpRedirectAddr != "" {
+			go func() {
+				if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					log.Fatal(err.Error())
+				}
+			}()
+			logger.Log(signalsrv.LevelInfo, "https redirect listening", signalsrv.F("addr", *httpRedirectAddr))
+		}
+	} else {
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err.Error())
+			}
+		}()
+		logger.Log(signalsrv.LevelInfo, "websockets/http listening", signalsrv.F("addr", *addr), signalsrv.F("version", signalsrv.Version))
 	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/metrics", wns.Metrics())
+	adminMux.Handle("/healthz", wns.Liveness())
+	adminMux.Handle("/readyz", wns.Readiness())
+	adminMux.Handle("/version", signalsrv.VersionHandler())
+	adminAPI := signalsrv.NewAdminAPI(wns, *adminToken)
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
 			log.Fatal(err.Error())
 		}
-	}()
-	log.Println("websockets/http listening on ", *addr)
+		defer f.Close()
+		adminAPI.SetAuditLogger(signalsrv.NewJSONLogger(f))
+	}
+	adminMux.Handle("/log", adminAPI.Protect(wns.Verbosity()))
+	adminMux.Handle("/api/", adminAPI)
+	if recorder != nil {
+		adminMux.Handle("/record", adminAPI.Protect(recorder))
+	}
+	adminSrv := &http.Server{
+		Addr:         *adminAddr,
+		Handler:      adminMux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	if *adminAddr != "" {
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err.Error())
+			}
+		}()
+		logger.Log(signalsrv.LevelInfo, "admin http listening", signalsrv.F("addr", *adminAddr))
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("shutdown Server...")
+	logger.Log(signalsrv.LevelInfo, "shutdown server")
+	wns.Drain()
+	time.Sleep(*drainDelay)
 
 	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal(err.Error())
 	}
+	if err := redirectSrv.Shutdown(ctx); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := wns.Shutdown(ctx); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := adminSrv.Shutdown(ctx); err != nil {
+		log.Fatal(err.Error())
+	}
+	if recorder != nil {
+		recorder.Close()
+	}
+	if tracer != nil {
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+}
+
+// splitList splits a comma separated flag, nil if it is empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
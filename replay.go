@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/huaishan/awsignal/signalsrv"
+)
+
+// runReplay implements "awsignal replay [flags] recording.jsonl".
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	url := fs.String("url", "", "websocket url of the app to replay against, empty to start an in-process server")
+	sharing := fs.Bool("sharing", false, "enable address sharing for the in-process app")
+	speed := fs.Float64("speed", 1, "timing scale of the recording, 2 replays twice as fast")
+	fast := fs.Bool("fast", false, "replay as fast as possible, only waiting for expected events")
+	timeout := fs.Duration("timeout", 5*time.Second, "wait at most this long for each expected event")
+	jsonOut := fs.Bool("json", false, "print the result as json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay [flags] recording.jsonl\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	records, err := signalsrv.ReadRecords(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(records) == 0 {
+		fmt.Fprintln(os.Stderr, "recording is empty")
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+	if *url == "" {
+		stop, u, err := serveReplay(records[0].App, *sharing)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer stop()
+		*url = u
+	}
+	if *fast {
+		*speed = 0
+	}
+
+	result, err := signalsrv.Replay(ctx, records, signalsrv.ReplayConfig{URL: *url, Speed: *speed, Timeout: *timeout})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *jsonOut {
+		json.NewEncoder(os.Stdout).Encode(result)
+	} else {
+		fmt.Printf("peers=%d sent=%d received=%d diffs=%d\n", result.Peers, result.Sent, result.Received, len(result.Diffs))
+		for _, d := range result.Diffs {
+			fmt.Printf("peer %d #%d\n  expected: %s\n  observed: %s\n", d.Peer, d.Index, orNone(d.Expected), orNone(d.Observed))
+		}
+	}
+	if len(result.Diffs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return strings.TrimSpace(s)
+}
+
+// serveReplay starts an in-process server for app on a loopback port.
+func serveReplay(app string, sharing bool) (func(), string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	verbosity := signalsrv.NewVerbosity(signalsrv.LevelWarn)
+	wns := signalsrv.NewWebsocketNetworkServer(&signalsrv.ServerConfig{Verbosity: verbosity})
+	conf := &signalsrv.AppConfig{Path: "/", AppName: app, AddressSharing: sharing}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wns.HandleUpgrade(w, r, conf)
+	})}
+	go srv.Serve(ln)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		wns.Shutdown(ctx)
+	}, "ws://" + ln.Addr().String() + "/", nil
+}
@@ -0,0 +1,256 @@
+package signalsrv
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Parameters of the address extension. A client sends "room?secret=abc"
+// instead of "room" to listen on or connect to the address "room" with a
+// secret. Listeners may add invite_only=1, connectors invite=<token> and,
+// for apps with KnockToJoin, meta=<text> for the join request. awrtc clients
+// that don't use the extension send plain addresses.
+const (
+	AddressSecretParam     = "secret"
+	AddressInviteParam     = "invite"
+	AddressInviteOnlyParam = "invite_only"
+	AddressMetaParam       = "meta"
+)
+
+// Reasons a locked address refuses a peer, they are sent to the client as a
+// Warning event before the failure event.
+const (
+	AccessSecretRequired = "secret required"
+	AccessInvalidSecret  = "invalid secret"
+	AccessInviteRequired = "invite required"
+	AccessInvalidInvite  = "invalid invite"
+)
+
+// maxExtensionLength is how much longer than the pool's maxAddressLength an
+// address may be with the parameters of the extension, meta included.
+const maxExtensionLength = 512
+
+type addressAccess struct {
+	secret     string
+	invite     string
+	inviteOnly bool
+	meta       string
+}
+
+// splitAddress separates the extension parameters from an address. A suffix
+// without any of them is part of the address.
+func splitAddress(s string) (string, addressAccess) {
+	i := strings.LastIndex(s, "?")
+	if i < 0 {
+		return s, addressAccess{}
+	}
+	q, err := url.ParseQuery(s[i+1:])
+	if err != nil {
+		return s, addressAccess{}
+	}
+	_, secret := q[AddressSecretParam]
+	_, invite := q[AddressInviteParam]
+	_, inviteOnly := q[AddressInviteOnlyParam]
+	_, meta := q[AddressMetaParam]
+	if !secret && !invite && !inviteOnly && !meta {
+		return s, addressAccess{}
+	}
+	only, _ := strconv.ParseBool(q.Get(AddressInviteOnlyParam))
+	return s[:i], addressAccess{
+		secret:     q.Get(AddressSecretParam),
+		invite:     q.Get(AddressInviteParam),
+		inviteOnly: only,
+		meta:       q.Get(AddressMetaParam),
+	}
+}
+
+// addressTooLong checks the address a peer sent before its extension is
+// split off.
+func (pp *PeerPool) addressTooLong(raw string) bool {
+	return len(raw) > pp.maxAddressLength+maxExtensionLength
+}
+
+// maskAccess returns evt with the secret and invite of the address it names
+// masked, for logs, recordings and taps. Other events are returned as is.
+func maskAccess(evt *NetworkEvent) *NetworkEvent {
+	info := evt.GetInfo()
+	if info == nil || info.StringData == nil ||
+		(evt.Type != NetEventTypeNewConnection && evt.Type != NetEventTypeServerInitialized) {
+		return evt
+	}
+	masked := maskAddress(*info.StringData)
+	if masked == *info.StringData {
+		return evt
+	}
+	return NewNetworkEvent(evt.Type, evt.ConnectionId, &NetEventData{Type: NetEventDataTypeUTF16String, StringData: &masked})
+}
+
+func maskAddress(s string) string {
+	address, access := splitAddress(s)
+	if access.secret == "" && access.invite == "" {
+		return s
+	}
+	q, _ := url.ParseQuery(s[len(address)+1:])
+	for _, key := range []string{AddressSecretParam, AddressInviteParam} {
+		if _, ok := q[key]; ok {
+			q.Set(key, "redacted")
+		}
+	}
+	return address + "?" + q.Encode()
+}
+
+// addressLock is set by the first listener of an address and lasts until the
+// address is released.
+type addressLock struct {
+	secret     [sha256.Size]byte
+	hasSecret  bool
+	inviteOnly bool
+}
+
+// maxInviteTTL is the lifetime of invites issued without a ttl.
+var maxInviteTTL = 24 * time.Hour
+
+var errNotLocked = errors.New("address is not locked")
+
+var errAddressTooLong = errors.New("address too long")
+
+// Invite lets connectors into a locked address without its secret. It is
+// only valid as long as the lock it was issued for.
+type Invite struct {
+	Token   string `json:"token"`
+	Address string `json:"address"`
+	// Uses is how often the invite can still be used, 0 is unlimited until
+	// it expires.
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	lock      *addressLock
+}
+
+// lockAddress locks address if the first listener asks for it. The pool must
+// be locked.
+func (pp *PeerPool) lockAddress(address string, access addressAccess) {
+	if access.secret == "" && !access.inviteOnly {
+		return
+	}
+	lock := &addressLock{inviteOnly: access.inviteOnly}
+	if access.secret != "" {
+		lock.secret = sha256.Sum256([]byte(access.secret))
+		lock.hasSecret = true
+	}
+	pp.locks[address] = lock
+}
+
+// unlockAddress drops the lock of a released address with its invites. The
+// pool must be locked.
+func (pp *PeerPool) unlockAddress(address string) {
+	if _, ok := pp.locks[address]; !ok {
+		return
+	}
+	delete(pp.locks, address)
+	for token, invite := range pp.invites {
+		if invite.Address == address {
+			delete(pp.invites, token)
+		}
+	}
+}
+
+func (pp *PeerPool) isLocked(address string) bool {
+	_, ok := pp.locks[address]
+	return ok
+}
+
+// admit checks access against the lock of address and uses up the invite
+// that lets the peer in. It returns why the peer is refused, empty if it
+// isn't. The pool must be locked.
+func (pp *PeerPool) admit(address string, access addressAccess) string {
+	lock, ok := pp.locks[address]
+	if !ok {
+		return ""
+	}
+	if access.invite != "" {
+		if !pp.useInvite(address, access.invite) {
+			return AccessInvalidInvite
+		}
+		return ""
+	}
+	if lock.inviteOnly || !lock.hasSecret {
+		return AccessInviteRequired
+	}
+	if access.secret == "" {
+		return AccessSecretRequired
+	}
+	sum := sha256.Sum256([]byte(access.secret))
+	if subtle.ConstantTimeCompare(sum[:], lock.secret[:]) != 1 {
+		return AccessInvalidSecret
+	}
+	return ""
+}
+
+// IssueInvite creates an invite to the locked address. It can be used uses
+// times, or without limit until it expires after ttl. At least one of them is
+// required, invites without a ttl expire after maxInviteTTL.
+func (pp *PeerPool) IssueInvite(address string, uses int, ttl time.Duration) (Invite, error) {
+	if uses < 0 || ttl < 0 || (uses == 0 && ttl == 0) {
+		return Invite{}, errors.New("an invite needs uses or a ttl")
+	}
+	if ttl == 0 {
+		ttl = maxInviteTTL
+	}
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return Invite{}, errors.Wrap(err, "invite token")
+	}
+	now := time.Now()
+	expires := now.Add(ttl)
+	invite := &Invite{Token: base64.RawURLEncoding.EncodeToString(b), Address: address, Uses: uses, ExpiresAt: &expires}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	lock, ok := pp.locks[address]
+	if !ok {
+		return Invite{}, errors.Wrap(errNotLocked, address)
+	}
+	invite.lock = lock
+	for token, other := range pp.invites {
+		if !now.Before(*other.ExpiresAt) {
+			delete(pp.invites, token)
+		}
+	}
+	pp.invites[invite.Token] = invite
+	return *invite, nil
+}
+
+// useInvite must be called with the pool locked.
+func (pp *PeerPool) useInvite(address, token string) bool {
+	invite, ok := pp.invites[token]
+	if !ok || invite.Address != address || invite.lock != pp.locks[address] {
+		return false
+	}
+	if !time.Now().Before(*invite.ExpiresAt) {
+		delete(pp.invites, token)
+		return false
+	}
+	if invite.Uses > 0 {
+		invite.Uses--
+		if invite.Uses == 0 {
+			delete(pp.invites, token)
+		}
+	}
+	return true
+}
+
+// refuseAccess logs and tells the client why it wasn't let into address, the
+// failure event itself follows.
+func (sp *SignalingPeer) refuseAccess(address, reason string) {
+	sp.logScoped(LevelInfo, address, "access refused", F("reason", reason))
+	msg := "address " + address + ": " + reason
+	sp.sendToClient(NewNetworkEvent(NetEventTypeWarning, INVALIDConnectionId,
+		&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &msg}))
+}
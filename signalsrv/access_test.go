@@ -0,0 +1,255 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitAddress(t *testing.T) {
+	tests := []struct {
+		raw, address string
+		access       addressAccess
+	}{
+		{"room", "room", addressAccess{}},
+		{"room?x=1", "room?x=1", addressAccess{}},
+		{"what?", "what?", addressAccess{}},
+		{"room?secret=s3", "room", addressAccess{secret: "s3"}},
+		{"a?b?secret=x%26y", "a?b", addressAccess{secret: "x&y"}},
+		{"vip?invite_only=1", "vip", addressAccess{inviteOnly: true}},
+		{"vip?invite=abc", "vip", addressAccess{invite: "abc"}},
+		{"desk?meta=order+42", "desk", addressAccess{meta: "order 42"}},
+	}
+	for _, test := range tests {
+		address, access := splitAddress(test.raw)
+		if address != test.address || access != test.access {
+			t.Errorf("expected %q %+v for %q got: %q %+v", test.address, test.access, test.raw, address, access)
+		}
+	}
+}
+
+func TestMaskAddress(t *testing.T) {
+	tests := []struct{ raw, want string }{
+		{"room", "room"},
+		{"room?x=1", "room?x=1"},
+		{"room?meta=hi", "room?meta=hi"},
+		{"room?secret=s3&invite_only=1", "room?invite_only=1&secret=redacted"},
+		{"room?invite=abc", "room?invite=redacted"},
+	}
+	for _, test := range tests {
+		if want, got := test.want, maskAddress(test.raw); want != got {
+			t.Errorf("expected %s got: %s", want, got)
+		}
+	}
+}
+
+func TestAddressSecretNotRecorded(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec, err := NewRecorder(RecorderConfig{Dir: dir, Unredacted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Enable("Test", "room")
+	_, url, closeServer := newTestServer(t, &ServerConfig{Recorder: rec}, &AppConfig{Path: "/", AppName: "Test"})
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room?secret=s3cr3t")
+	listener.expect(t, NetEventTypeServerInitialized)
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	c.send(t, NetEventTypeNewConnection, 1, "room?secret=s3cr3t")
+	c.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+	closeServer()
+	rec.Close()
+
+	var types []string
+	for _, r := range readRecords(t, filepath.Join(dir, "Test@room.jsonl")) {
+		types = append(types, r.Direction+" "+r.Type)
+		if r.Address != "room" {
+			t.Errorf("expected address room got: %s", r.Address)
+		}
+		if r.Data != nil && strings.Contains(*r.Data, "s3cr3t") {
+			t.Errorf("expected the secret to be masked got: %s", *r.Data)
+		}
+	}
+	if len(types) < 2 || types[0] != "in ServerInitialized" || !strings.Contains(strings.Join(types, ","), "in NewConnection") {
+		t.Errorf("expected the events naming the address to be recorded got: %v", types)
+	}
+}
+
+func TestAddressSecret(t *testing.T) {
+	_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room?secret=s3")
+	if want, got := "room", *listener.expect(t, NetEventTypeServerInitialized).GetInfo().StringData; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	for id, address := range []string{"room", "room?secret=nope"} {
+		c.send(t, NetEventTypeNewConnection, int16(id), address)
+		if warning := *c.expect(t, NetEventTypeWarning).GetInfo().StringData; !strings.HasPrefix(warning, "address room: ") {
+			t.Errorf("expected a reason got: %s", warning)
+		}
+		c.expect(t, NetEventTypeConnectionFailed)
+	}
+	c.send(t, NetEventTypeNewConnection, 5, "room?secret=s3")
+	c.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+
+	// the lock goes with the address
+	listener.send(t, NetEventTypeServerClosed, -1, "")
+	listener.expect(t, NetEventTypeServerClosed)
+	listener.send(t, NetEventTypeServerInitialized, -1, "room")
+	listener.expect(t, NetEventTypeServerInitialized)
+	c.send(t, NetEventTypeNewConnection, 6, "room")
+	c.expect(t, NetEventTypeNewConnection)
+}
+
+func TestAddressExtensionTooLong(t *testing.T) {
+	_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+
+	meta := strings.Repeat("m", maxExtensionLength+256)
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room?meta="+meta)
+	if want, got := "room", *listener.expect(t, NetEventTypeServerInitFailed).GetInfo().StringData; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	listener.send(t, NetEventTypeServerInitialized, -1, "room?meta=short")
+	listener.expect(t, NetEventTypeServerInitialized)
+
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	c.send(t, NetEventTypeNewConnection, 1, "room?meta="+meta)
+	c.expect(t, NetEventTypeConnectionFailed)
+	listener.expectNone(t, 50*time.Millisecond)
+}
+
+func TestAddressInvites(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "vip?invite_only=1&secret=s3")
+	listener.expect(t, NetEventTypeServerInitialized)
+	pool := testPool(wns, "Test")
+	once, _ := pool.IssueInvite("vip", 1, 0)
+	if once.ExpiresAt == nil || once.ExpiresAt.After(time.Now().Add(maxInviteTTL)) {
+		t.Errorf("expected an invite without ttl to expire got: %v", once.ExpiresAt)
+	}
+	if _, err := pool.IssueInvite("other", 1, 0); err == nil {
+		t.Error("expected an invite to an unlocked address to fail")
+	}
+	expired, _ := pool.IssueInvite("vip", 0, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	for id, address := range []string{"vip?secret=s3", "vip?invite=nope", "vip?invite=" + expired.Token} {
+		c.send(t, NetEventTypeNewConnection, int16(id), address)
+		c.expect(t, NetEventTypeWarning)
+		c.expect(t, NetEventTypeConnectionFailed)
+	}
+	c.send(t, NetEventTypeNewConnection, 5, "vip?invite="+once.Token)
+	c.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+	c.send(t, NetEventTypeNewConnection, 6, "vip?invite="+once.Token)
+	c.expect(t, NetEventTypeWarning)
+	c.expect(t, NetEventTypeConnectionFailed)
+
+	if _, err := pool.IssueInvite("vip", 0, 0); err == nil {
+		t.Error("expected an invite without uses or ttl to fail")
+	}
+
+	// invites go with the lock they were issued for
+	stale, _ := pool.IssueInvite("vip", 0, time.Minute)
+	listener.send(t, NetEventTypeServerClosed, -1, "")
+	listener.expect(t, NetEventTypeServerClosed)
+	listener.send(t, NetEventTypeServerInitialized, -1, "vip?secret=other")
+	listener.expect(t, NetEventTypeServerInitialized)
+	c.send(t, NetEventTypeNewConnection, 7, "vip?invite="+stale.Token)
+	c.expect(t, NetEventTypeWarning)
+	c.expect(t, NetEventTypeConnectionFailed)
+	pool.mu.Lock()
+	left := len(pool.invites)
+	pool.mu.Unlock()
+	if want, got := 0, left; want != got {
+		t.Errorf("expected %d invites got: %d", want, got)
+	}
+}
+
+func TestSharedRoomSecret(t *testing.T) {
+	_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", AddressSharing: true})
+	defer closeServer()
+
+	first := dialTestClient(t, url)
+	defer first.conn.Close()
+	first.send(t, NetEventTypeServerInitialized, -1, "room?secret=s3")
+	first.expect(t, NetEventTypeServerInitialized)
+
+	second := dialTestClient(t, url)
+	defer second.conn.Close()
+	second.send(t, NetEventTypeServerInitialized, -1, "room")
+	second.expect(t, NetEventTypeWarning)
+	if want, got := "room", *second.expect(t, NetEventTypeServerInitFailed).GetInfo().StringData; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	second.send(t, NetEventTypeServerInitialized, -1, "room?secret=s3")
+	second.expect(t, NetEventTypeServerInitialized)
+	second.expect(t, NetEventTypeNewConnection)
+	first.expect(t, NetEventTypeNewConnection)
+}
+
+func TestAdminInvites(t *testing.T) {
+	api, pool, _ := newTestAdmin(t)
+	pool.mu.Lock()
+	pool.lockAddress("room", addressAccess{secret: "s3"})
+	pool.mu.Unlock()
+	issue := func(form url.Values) (int, Invite) {
+		r := httptest.NewRequest(http.MethodPost, "/api/apps/Test/invites", strings.NewReader(form.Encode()))
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		var invite Invite
+		json.Unmarshal(w.Body.Bytes(), &invite)
+		return w.Code, invite
+	}
+	status, invite := issue(url.Values{"address": {"room"}})
+	if status != http.StatusOK || invite.Uses != 1 || invite.Token == "" {
+		t.Errorf("expected a single use invite got: %d %+v", status, invite)
+	}
+	if status, invite := issue(url.Values{"address": {"room"}, "ttl": {"1m"}}); status != http.StatusOK || invite.Uses != 0 || invite.ExpiresAt == nil {
+		t.Errorf("expected a time limited invite got: %d %+v", status, invite)
+	}
+	if status, _ := issue(url.Values{"address": {"other"}}); status != http.StatusConflict {
+		t.Errorf("expected %d for an unlocked address got: %d", http.StatusConflict, status)
+	}
+	for _, form := range []url.Values{{}, {"address": {"room"}, "ttl": {"soon"}}, {"address": {"room"}, "uses": {"-1"}}} {
+		if status, _ := issue(form); status != http.StatusBadRequest {
+			t.Errorf("expected %d for %v got: %d", http.StatusBadRequest, form, status)
+		}
+	}
+	pool.mu.Lock()
+	ok := pool.useInvite("room", invite.Token)
+	pool.mu.Unlock()
+	if !ok {
+		t.Error("expected the issued invite to be usable")
+	}
+}
@@ -0,0 +1,561 @@
+package signalsrv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const (
+	adminDefaultLimit = 100
+	adminMaxLimit     = 1000
+)
+
+type AppInfo struct {
+	Name           string `json:"name"`
+	Path           string `json:"path"`
+	AddressSharing bool   `json:"address_sharing"`
+	Peers          int    `json:"peers"`
+	Addresses      int    `json:"addresses"`
+}
+
+type PeerSummary struct {
+	ID     PeerId `json:"id"`
+	Remote string `json:"remote"`
+}
+
+type AddressInfo struct {
+	Address   string        `json:"address"`
+	Locked    bool          `json:"locked,omitempty"`
+	Listeners []PeerSummary `json:"listeners"`
+}
+
+type LinkInfo struct {
+	ConnectionId int16       `json:"connection_id"`
+	Peer         PeerSummary `json:"peer"`
+}
+
+type PeerInfo struct {
+	ID          PeerId     `json:"id"`
+	Remote      string     `json:"remote"`
+	State       string     `json:"state"`
+	User        string     `json:"user,omitempty"`
+	Tenant      string     `json:"tenant,omitempty"`
+	Address     string     `json:"address,omitempty"`
+	QueueDepth  int        `json:"queue_depth"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	RTT         RTTStats   `json:"rtt"`
+	Connections []LinkInfo `json:"connections"`
+}
+
+type Page struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Items  interface{} `json:"items"`
+}
+
+func (sp *SignalingPeer) summary() PeerSummary {
+	return PeerSummary{ID: sp.id, Remote: sp.connInfo}
+}
+
+// info must be called with the pool locked.
+func (sp *SignalingPeer) info() PeerInfo {
+	info := PeerInfo{
+		ID:          sp.id,
+		Remote:      sp.connInfo,
+		State:       stateName(sp.state),
+		QueueDepth:  len(sp.send),
+		ConnectedAt: sp.connectedAt,
+		RTT:         sp.rtt.stats(),
+		Connections: make([]LinkInfo, 0, len(sp.connections)),
+	}
+	if sp.serverAddress != nil {
+		info.Address = *sp.serverAddress
+	}
+	if sp.claims != nil {
+		info.User = sp.claims.Subject
+		info.Tenant = sp.claims.Tenant
+	}
+	for id, peer := range sp.connections {
+		info.Connections = append(info.Connections, LinkInfo{ConnectionId: id, Peer: peer.summary()})
+	}
+	sort.Slice(info.Connections, func(i, j int) bool {
+		return info.Connections[i].ConnectionId < info.Connections[j].ConnectionId
+	})
+	return info
+}
+
+func (pp *PeerPool) info() AppInfo {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return AppInfo{
+		Name:           pp.appConfig.AppName,
+		Path:           pp.appConfig.Path,
+		AddressSharing: pp.addressSharing,
+		Peers:          pp.count(),
+		Addresses:      len(pp.servers),
+	}
+}
+
+func (pp *PeerPool) addressInfos(prefix string) []AddressInfo {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	infos := make([]AddressInfo, 0)
+	for address, listeners := range pp.servers {
+		if !strings.HasPrefix(address, prefix) {
+			continue
+		}
+		info := AddressInfo{Address: address, Locked: pp.isLocked(address), Listeners: make([]PeerSummary, 0, len(listeners))}
+		for _, sp := range listeners {
+			info.Listeners = append(info.Listeners, sp.summary())
+		}
+		sort.Slice(info.Listeners, func(i, j int) bool { return info.Listeners[i].ID < info.Listeners[j].ID })
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Address < infos[j].Address })
+	return infos
+}
+
+// peerInfos pages through the peers listening on an address with the given
+// prefix, an empty prefix lists every peer. The pool is only locked to pick
+// the peers and to describe the ones on the page, so listing a large pool
+// doesn't hold up its routing.
+func (pp *PeerPool) peerInfos(prefix string, offset, limit int) (int, []PeerInfo) {
+	pp.mu.Lock()
+	peers := make([]*SignalingPeer, 0, len(pp.connections))
+	for _, sp := range pp.connections {
+		if prefix == "" || (sp.serverAddress != nil && strings.HasPrefix(*sp.serverAddress, prefix)) {
+			peers = append(peers, sp)
+		}
+	}
+	pp.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].id < peers[j].id })
+	lo, hi := pageBounds(len(peers), offset, limit)
+	infos := make([]PeerInfo, 0, hi-lo)
+	pp.mu.Lock()
+	for _, sp := range peers[lo:hi] {
+		infos = append(infos, sp.info())
+	}
+	pp.mu.Unlock()
+	return len(peers), infos
+}
+
+func (pp *PeerPool) findPeer(id PeerId) *SignalingPeer {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.ids[id]
+}
+
+// closeAddress stops every listener of address, connected peers stay linked.
+func (pp *PeerPool) closeAddress(address string) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	listeners := append([]*SignalingPeer(nil), pp.servers[address]...)
+	for _, sp := range listeners {
+		sp.stopServer()
+	}
+	return len(listeners)
+}
+
+// notice sends a Warning event with message to the peers of address, or to
+// every peer of the app if address is empty. Peers connected to a listener
+// count as peers of its address.
+func (pp *PeerPool) notice(address, message string) int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	var peers []*SignalingPeer
+	if address == "" {
+		peers = pp.connections
+	} else {
+		seen := make(map[*SignalingPeer]bool)
+		for _, listener := range pp.servers[address] {
+			for _, sp := range append([]*SignalingPeer{listener}, linkedPeers(listener)...) {
+				if !seen[sp] {
+					seen[sp] = true
+					peers = append(peers, sp)
+				}
+			}
+		}
+	}
+	for _, sp := range peers {
+		sp.sendToClient(NewNetworkEvent(NetEventTypeWarning, INVALIDConnectionId,
+			&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &message}))
+	}
+	return len(peers)
+}
+
+func linkedPeers(sp *SignalingPeer) []*SignalingPeer {
+	peers := make([]*SignalingPeer, 0, len(sp.connectionIds))
+	for peer := range sp.connectionIds {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (wns *WebsocketNetworkServer) getPool(app string) *PeerPool {
+	wns.mu.Lock()
+	defer wns.mu.Unlock()
+	return wns.pool[app]
+}
+
+// AdminAPI serves the admin endpoints below /api/. Every request needs the
+// admin token as a bearer token, without a token the API is disabled.
+//
+//	GET /api/apps
+//	GET /api/apps/{app}/addresses?prefix=&offset=&limit=
+//	GET /api/apps/{app}/peers?prefix=&offset=&limit=
+//	GET /api/apps/{app}/peers/{id}
+//	POST /api/apps/{app}/peers/{id}/kick
+//	POST /api/apps/{app}/addresses/close address=
+//	POST /api/apps/{app}/notice message=&address=
+//	POST /api/apps/{app}/invites address=&uses=&ttl= (locked addresses, uses defaults to 1 without a ttl)
+//	GET /api/tap?app=&address=&payloads= (websocket, token may be a query parameter)
+//	GET /api/bans
+//	POST /api/bans kind=ip|user|address&value=&app=&reason=&ttl=
+//	DELETE /api/bans/{id}
+//
+// Actions and rejected requests are written to the audit log.
+type AdminAPI struct {
+	server *WebsocketNetworkServer
+	token  string
+	audit  Logger
+}
+
+func NewAdminAPI(server *WebsocketNetworkServer, token string) *AdminAPI {
+	return &AdminAPI{server: server, token: token, audit: server.logger}
+}
+
+// SetAuditLogger replaces the audit log, which defaults to the server logger.
+func (api *AdminAPI) SetAuditLogger(logger Logger) {
+	api.audit = logger
+}
+
+func (api *AdminAPI) auditLog(r *http.Request, action string, status int, fields ...Field) {
+	level := LevelInfo
+	if status >= http.StatusBadRequest {
+		level = LevelWarn
+	}
+	fields = append([]Field{F("action", action), F("remote", r.RemoteAddr), F("status", status)}, fields...)
+	api.audit.Log(level, "admin audit", fields...)
+}
+
+// Protect requires the admin token for h.
+func (api *AdminAPI) Protect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.token == "" {
+			api.auditLog(r, "auth", http.StatusForbidden, F("path", r.URL.Path))
+			writeError(w, http.StatusForbidden, "admin token not configured")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		// browsers can't set headers on websocket handshakes
+		if token == "" && websocket.IsWebSocketUpgrade(r) {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			api.auditLog(r, "auth", http.StatusUnauthorized, F("path", r.URL.Path))
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.Protect(http.HandlerFunc(api.route)).ServeHTTP(w, r)
+}
+
+func (api *AdminAPI) route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/"), "/")
+	if len(parts) == 1 && parts[0] == "tap" {
+		api.tap(w, r)
+		return
+	}
+	if len(parts) <= 2 && parts[0] == "bans" {
+		api.routeBans(w, r, parts[1:])
+		return
+	}
+	if len(parts) == 0 || parts[0] != "apps" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		api.listApps(w, r)
+		return
+	}
+
+	pool := api.server.getPool(parts[1])
+	if pool == nil {
+		writeError(w, http.StatusNotFound, "unknown app")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		api.routeRead(w, r, pool, parts[2:])
+	case http.MethodPost:
+		api.routeAction(w, r, pool, parts[2:])
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (api *AdminAPI) routeRead(w http.ResponseWriter, r *http.Request, pool *PeerPool, parts []string) {
+	switch {
+	case len(parts) == 1 && parts[0] == "addresses":
+		if offset, limit, ok := pageParams(w, r); ok {
+			infos := pool.addressInfos(r.URL.Query().Get("prefix"))
+			lo, hi := pageBounds(len(infos), offset, limit)
+			writeJSON(w, http.StatusOK, Page{Total: len(infos), Offset: offset, Limit: limit, Items: infos[lo:hi]})
+		}
+	case len(parts) == 1 && parts[0] == "peers":
+		if offset, limit, ok := pageParams(w, r); ok {
+			total, infos := pool.peerInfos(r.URL.Query().Get("prefix"), offset, limit)
+			writeJSON(w, http.StatusOK, Page{Total: total, Offset: offset, Limit: limit, Items: infos})
+		}
+	case len(parts) == 2 && parts[0] == "peers":
+		sp := api.findPeer(w, pool, parts[1])
+		if sp == nil {
+			return
+		}
+		pool.mu.Lock()
+		info := sp.info()
+		pool.mu.Unlock()
+		writeJSON(w, http.StatusOK, info)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (api *AdminAPI) routeAction(w http.ResponseWriter, r *http.Request, pool *PeerPool, parts []string) {
+	app := pool.appConfig.AppName
+	switch {
+	case len(parts) == 3 && parts[0] == "peers" && parts[2] == "kick":
+		sp := api.findPeer(w, pool, parts[1])
+		if sp == nil {
+			api.auditLog(r, "kick", http.StatusNotFound, F("app", app), F("peer", parts[1]))
+			return
+		}
+		// Close takes the pool lock itself and runs the disconnect fan-out.
+		sp.Close(DisconnectKicked)
+		api.auditLog(r, "kick", http.StatusOK, F("app", app), F("peer", sp.id))
+		writeJSON(w, http.StatusOK, map[string]int{"peers": 1})
+	case len(parts) == 2 && parts[0] == "addresses" && parts[1] == "close":
+		address := r.FormValue("address")
+		if address == "" {
+			api.auditLog(r, "close_address", http.StatusBadRequest, F("app", app))
+			writeError(w, http.StatusBadRequest, "missing address")
+			return
+		}
+		n := pool.closeAddress(address)
+		api.auditLog(r, "close_address", http.StatusOK, F("app", app), F("address", address), F("peers", n))
+		writeJSON(w, http.StatusOK, map[string]int{"peers": n})
+	case len(parts) == 1 && parts[0] == "notice":
+		message, address := r.FormValue("message"), r.FormValue("address")
+		if message == "" {
+			api.auditLog(r, "notice", http.StatusBadRequest, F("app", app), F("address", address))
+			writeError(w, http.StatusBadRequest, "missing message")
+			return
+		}
+		n := pool.notice(address, message)
+		api.auditLog(r, "notice", http.StatusOK, F("app", app), F("address", address), F("peers", n))
+		writeJSON(w, http.StatusOK, map[string]int{"peers": n})
+	case len(parts) == 1 && parts[0] == "invites":
+		address := r.FormValue("address")
+		invite, err := issueInvite(pool, r)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Cause(err) == errNotLocked {
+				status = http.StatusConflict
+			}
+			api.auditLog(r, "invite", status, F("app", app), F("address", address))
+			writeError(w, status, err.Error())
+			return
+		}
+		// the token is a secret, it stays out of the audit log
+		api.auditLog(r, "invite", http.StatusOK, F("app", app), F("address", address), F("uses", invite.Uses), F("expires_at", invite.ExpiresAt))
+		writeJSON(w, http.StatusOK, invite)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// issueInvite issues the invite a request asks for, a single use one unless
+// it has uses or a ttl.
+func issueInvite(pool *PeerPool, r *http.Request) (Invite, error) {
+	address := r.FormValue("address")
+	if address == "" {
+		return Invite{}, errors.New("missing address")
+	}
+	var uses int
+	var ttl time.Duration
+	var err error
+	if s := r.FormValue("uses"); s != "" {
+		if uses, err = strconv.Atoi(s); err != nil {
+			return Invite{}, errors.New("invalid uses")
+		}
+	}
+	if s := r.FormValue("ttl"); s != "" {
+		if ttl, err = time.ParseDuration(s); err != nil {
+			return Invite{}, errors.New("invalid ttl")
+		}
+	}
+	if uses == 0 && ttl == 0 {
+		uses = 1
+	}
+	return pool.IssueInvite(address, uses, ttl)
+}
+
+func (api *AdminAPI) tap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	app, address := query.Get("app"), query.Get("address")
+	if app == "" {
+		writeError(w, http.StatusBadRequest, "missing app")
+		return
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeError(w, http.StatusBadRequest, "websocket upgrade required")
+		return
+	}
+	payloads, _ := strconv.ParseBool(query.Get("payloads"))
+	api.auditLog(r, "tap", http.StatusSwitchingProtocols, F("app", app), F("address", address), F("payloads", payloads))
+	api.server.serveTap(w, r, app, address, payloads)
+	api.auditLog(r, "tap_closed", http.StatusOK, F("app", app), F("address", address))
+}
+
+func (api *AdminAPI) routeBans(w http.ResponseWriter, r *http.Request, parts []string) {
+	bans := api.server.bans
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, bans.List())
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		ban := Ban{
+			Kind:   BanKind(r.FormValue("kind")),
+			Value:  r.FormValue("value"),
+			App:    r.FormValue("app"),
+			Reason: r.FormValue("reason"),
+		}
+		var ttl time.Duration
+		if s := r.FormValue("ttl"); s != "" {
+			var err error
+			if ttl, err = time.ParseDuration(s); err != nil || ttl < 0 {
+				api.auditLog(r, "ban", http.StatusBadRequest, F("kind", ban.Kind), F("value", ban.Value))
+				writeError(w, http.StatusBadRequest, "invalid ttl")
+				return
+			}
+		}
+		if err := ban.parse(); err != nil {
+			api.auditLog(r, "ban", http.StatusBadRequest, F("kind", ban.Kind), F("value", ban.Value))
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ban, err := bans.Add(ban, ttl)
+		if err != nil {
+			api.auditLog(r, "ban", http.StatusInternalServerError, F("kind", ban.Kind), F("value", ban.Value), F("error", err))
+			writeError(w, http.StatusInternalServerError, "ban not saved")
+			return
+		}
+		api.auditLog(r, "ban", http.StatusOK, F("id", ban.ID), F("kind", ban.Kind), F("value", ban.Value), F("app", ban.App), F("ttl", ttl))
+		writeJSON(w, http.StatusOK, ban)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid ban id")
+			return
+		}
+		ok, err := bans.Remove(id)
+		if err != nil {
+			api.auditLog(r, "unban", http.StatusInternalServerError, F("id", id), F("error", err))
+			writeError(w, http.StatusInternalServerError, "ban list not saved")
+			return
+		}
+		if !ok {
+			api.auditLog(r, "unban", http.StatusNotFound, F("id", id))
+			writeError(w, http.StatusNotFound, "unknown ban")
+			return
+		}
+		api.auditLog(r, "unban", http.StatusOK, F("id", id))
+		writeJSON(w, http.StatusOK, map[string]int{"bans": 1})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (api *AdminAPI) listApps(w http.ResponseWriter, r *http.Request) {
+	apps := make([]AppInfo, 0)
+	for _, pp := range api.server.pools() {
+		apps = append(apps, pp.info())
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	writeJSON(w, http.StatusOK, apps)
+}
+
+func (api *AdminAPI) findPeer(w http.ResponseWriter, pool *PeerPool, s string) *SignalingPeer {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid peer id")
+		return nil
+	}
+	sp := pool.findPeer(PeerId(id))
+	if sp == nil {
+		writeError(w, http.StatusNotFound, "unknown peer")
+	}
+	return sp
+}
+
+// pageParams reads the offset and limit query parameters, it writes the error
+// and returns false if they are invalid.
+func pageParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid offset")
+		return 0, 0, false
+	}
+	limit, err := queryInt(r, "limit", adminDefaultLimit)
+	if err != nil || limit < 1 || limit > adminMaxLimit {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return 0, 0, false
+	}
+	return offset, limit, true
+}
+
+func pageBounds(n, offset, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := offset + limit
+	if end > n {
+		end = n
+	}
+	return offset, end
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	s := r.URL.Query().Get(key)
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,250 @@
+package signalsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestAdmin(t *testing.T) (*AdminAPI, *PeerPool, []*SignalingPeer) {
+	wns := NewWebsocketNetworkServer(nil)
+	pool, peers := newTestRoom(3)
+	pool.server = wns
+	wns.pool[pool.appConfig.AppName] = pool
+	solo := newTestPeer(pool, "solo", 4)
+	solo.startServer("other")
+	peers = append(peers, solo)
+	for _, sp := range peers {
+		drain(sp)
+	}
+	return NewAdminAPI(wns, "secret"), pool, peers
+}
+
+func adminGet(api http.Handler, path, token string, v interface{}) int {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	if v != nil {
+		json.Unmarshal(w.Body.Bytes(), v)
+	}
+	return w.Code
+}
+
+func adminPost(api http.Handler, path string, form url.Values) int {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAdminAuth(t *testing.T) {
+	api, _, _ := newTestAdmin(t)
+	if want, got := http.StatusUnauthorized, adminGet(api, "/api/apps", "", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := http.StatusUnauthorized, adminGet(api, "/api/apps", "wrong", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := http.StatusForbidden, adminGet(NewAdminAPI(api.server, ""), "/api/apps", "", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := http.StatusOK, adminGet(api, "/api/apps", "secret", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+}
+
+func TestAdminApps(t *testing.T) {
+	api, _, _ := newTestAdmin(t)
+	var apps []AppInfo
+	adminGet(api, "/api/apps", "secret", &apps)
+	if want, got := 1, len(apps); want != got {
+		t.Fatalf("expected %d apps got: %d", want, got)
+	}
+	if want, got := (AppInfo{Name: "Test", AddressSharing: true, Peers: 4, Addresses: 2}), apps[0]; want != got {
+		t.Errorf("expected %+v got: %+v", want, got)
+	}
+	if want, got := http.StatusNotFound, adminGet(api, "/api/apps/Missing/peers", "secret", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+}
+
+func TestAdminAddresses(t *testing.T) {
+	api, _, peers := newTestAdmin(t)
+	var page struct {
+		Total int
+		Items []AddressInfo
+	}
+	adminGet(api, "/api/apps/Test/addresses?prefix=ro", "secret", &page)
+	if want, got := 1, page.Total; want != got {
+		t.Fatalf("expected %d addresses got: %d", want, got)
+	}
+	if want, got := "room", page.Items[0].Address; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if want, got := 3, len(page.Items[0].Listeners); want != got {
+		t.Fatalf("expected %d listeners got: %d", want, got)
+	}
+	if want, got := peers[0].ID(), page.Items[0].Listeners[0].ID; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+}
+
+func TestAdminPeers(t *testing.T) {
+	api, _, peers := newTestAdmin(t)
+	var page struct {
+		Total  int
+		Offset int
+		Items  []PeerInfo
+	}
+	adminGet(api, "/api/apps/Test/peers?prefix=room&offset=1&limit=1", "secret", &page)
+	if want, got := 3, page.Total; want != got {
+		t.Fatalf("expected %d peers got: %d", want, got)
+	}
+	if want, got := 1, len(page.Items); want != got {
+		t.Fatalf("expected %d items got: %d", want, got)
+	}
+	info := page.Items[0]
+	if want, got := peers[1].ID(), info.ID; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := "connected", info.State; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if want, got := 2, len(info.Connections); want != got {
+		t.Fatalf("expected %d connections got: %d", want, got)
+	}
+	for _, link := range info.Connections {
+		if got := peers[1].connections[link.ConnectionId]; got == nil || got.ID() != link.Peer.ID {
+			t.Errorf("expected connection %d to peer %d", link.ConnectionId, link.Peer.ID)
+		}
+	}
+
+	var single PeerInfo
+	path := fmt.Sprintf("/api/apps/Test/peers/%d", peers[3].ID())
+	if want, got := http.StatusOK, adminGet(api, path, "secret", &single); want != got {
+		t.Fatalf("expected %d got: %d", want, got)
+	}
+	if want, got := "other", single.Address; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if want, got := http.StatusBadRequest, adminGet(api, "/api/apps/Test/peers?limit=0", "secret", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+}
+
+func TestAdminKick(t *testing.T) {
+	for mode, config := range testModes {
+		t.Run(mode, func(t *testing.T) {
+			wns, url, closeServer := newTestServer(t, config, &AppConfig{Path: "/", AppName: "Test"})
+			defer verifyNoLeaks(t)
+			defer closeServer()
+			api := NewAdminAPI(wns, "secret")
+			var audit bytes.Buffer
+			api.SetAuditLogger(NewJSONLogger(&audit))
+
+			listener := dialTestClient(t, url)
+			defer listener.conn.Close()
+			listener.send(t, NetEventTypeServerInitialized, -1, "room")
+			listener.expect(t, NetEventTypeServerInitialized)
+			sp := testPool(wns, "Test").peers()[0]
+
+			connector := dialTestClient(t, url)
+			defer connector.conn.Close()
+			connector.send(t, NetEventTypeNewConnection, 1, "room")
+			connector.expect(t, NetEventTypeNewConnection)
+			listener.expect(t, NetEventTypeNewConnection)
+
+			path := fmt.Sprintf("/api/apps/Test/peers/%d/kick", sp.ID())
+			if want, got := http.StatusOK, adminPost(api, path, nil); want != got {
+				t.Fatalf("expected %d got: %d", want, got)
+			}
+			listener.expectClose(t, websocket.ClosePolicyViolation)
+			select {
+			case <-sp.Done():
+			case <-time.After(2 * time.Second):
+				t.Fatal("peer was not closed")
+			}
+			if want, got := DisconnectKicked, sp.reason; want != got {
+				t.Errorf("expected reason %s got: %s", want, got)
+			}
+			connector.expect(t, NetEventTypeDisconnected)
+
+			if want, got := http.StatusNotFound, adminPost(api, path, nil); want != got {
+				t.Errorf("expected %d got: %d", want, got)
+			}
+			if !strings.Contains(audit.String(), `"action":"kick"`) {
+				t.Errorf("expected kick in audit log got: %s", audit.String())
+			}
+		})
+	}
+}
+
+func TestAdminCloseAddress(t *testing.T) {
+	api, pool, peers := newTestAdmin(t)
+	form := url.Values{"address": {"room"}}
+	if want, got := http.StatusOK, adminPost(api, "/api/apps/Test/addresses/close", form); want != got {
+		t.Fatalf("expected %d got: %d", want, got)
+	}
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if _, ok := pool.servers["room"]; ok {
+		t.Error("expected room to be closed")
+	}
+	for _, sp := range peers[:3] {
+		events := drain(sp)
+		if want, got := 1, len(events); want != got {
+			t.Fatalf("expected %d events got: %d", want, got)
+		}
+		if want, got := NetEventTypeServerClosed, events[0].Type; want != got {
+			t.Errorf("expected %d got: %d", want, got)
+		}
+		if want, got := 2, len(sp.connections); want != got {
+			t.Errorf("expected %d connections got: %d", want, got)
+		}
+	}
+}
+
+func TestAdminNotice(t *testing.T) {
+	api, _, peers := newTestAdmin(t)
+	form := url.Values{"address": {"other"}, "message": {"maintenance"}}
+	if want, got := http.StatusOK, adminPost(api, "/api/apps/Test/notice", form); want != got {
+		t.Fatalf("expected %d got: %d", want, got)
+	}
+	for i, sp := range peers {
+		want := 0
+		if i == 3 {
+			want = 1
+		}
+		events := drain(sp)
+		if got := len(events); want != got {
+			t.Fatalf("expected %d events got: %d", want, got)
+		}
+		if want == 1 && *events[0].Data.StringData != "maintenance" {
+			t.Errorf("expected notice got: %s", events[0])
+		}
+	}
+
+	form.Del("address")
+	adminPost(api, "/api/apps/Test/notice", form)
+	for _, sp := range peers {
+		if want, got := 1, len(drain(sp)); want != got {
+			t.Errorf("expected %d events got: %d", want, got)
+		}
+	}
+	if want, got := http.StatusBadRequest, adminPost(api, "/api/apps/Test/notice", nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+}
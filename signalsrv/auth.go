@@ -0,0 +1,405 @@
+package signalsrv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TokenParam is the query parameter of the upgrade request that may carry
+	// the token.
+	TokenParam = "token"
+	// TokenProtocolPrefix marks the subprotocol that carries the token, for
+	// browsers that can't set headers on websocket requests.
+	TokenProtocolPrefix = "bearer."
+	// RejectAuth is the reason counted for upgrades without a valid token.
+	RejectAuth = "auth"
+)
+
+var jwksCheckInterval = time.Second
+
+var (
+	errNoToken      = errors.New("no token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// Claims are the verified claims of a peer's token.
+type Claims struct {
+	Subject   string    `json:"sub"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	ExpiresAt time.Time `json:"exp,omitempty"`
+	// Listen and Connect are the address patterns of the Policy, nil
+	// allows every address.
+	Listen  []string `json:"listen,omitempty"`
+	Connect []string `json:"connect,omitempty"`
+	// Reserved allows listening on the reserved addresses of the app.
+	Reserved bool `json:"reserved,omitempty"`
+}
+
+type AuthConfig struct {
+	// Secrets are the HMAC keys by key id. A token without a kid is checked
+	// against every secret, so a secret is rotated by adding the new one and
+	// removing the old one after its tokens expired.
+	Secrets map[string][]byte
+	// JWKSFile is a local JSON Web Key Set with RSA, EC or oct keys. It is
+	// read again whenever it changes.
+	JWKSFile string
+	// Issuer and Audience are checked if set.
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+	// Optional lets peers without a token in, a bad token is still rejected.
+	// Peers without a token have no claims and aren't limited by Policy.
+	Optional bool
+	// Policy applies to every token, a token's listen and connect claims
+	// take precedence over the patterns of the Policy.
+	Policy Policy
+}
+
+// Authenticator verifies the JWT of an upgrade request.
+type Authenticator struct {
+	config AuthConfig
+
+	mu          sync.Mutex
+	keys        []verificationKey
+	jwksModTime time.Time
+	jwksChecked time.Time
+}
+
+type verificationKey struct {
+	id  string
+	key interface{}
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{config: config}
+	if config.JWKSFile != "" {
+		a.jwksChecked = time.Now()
+		if err := a.loadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *Authenticator) leeway() time.Duration {
+	if a == nil {
+		return 0
+	}
+	return a.config.Leeway
+}
+
+// Authenticate verifies the token of r. It returns the subprotocol to answer
+// with if the token came as a subprotocol, and nil claims for a request
+// without a token if tokens are optional.
+func (a *Authenticator) Authenticate(r *http.Request) (*Claims, string, error) {
+	token, protocol := requestToken(r)
+	if token == "" {
+		if a.config.Optional {
+			return nil, "", nil
+		}
+		return nil, "", errNoToken
+	}
+	claims, err := a.Verify(token)
+	return claims, protocol, err
+}
+
+// authenticate checks the client certificate of r, then its token. Requests
+// with a certificate don't need a token.
+func (c *AppConfig) authenticate(r *http.Request) (*Claims, string, error) {
+	if c.ClientCerts != nil {
+		claims, err := c.ClientCerts.Authenticate(r)
+		if err != nil || claims != nil {
+			return claims, "", err
+		}
+	}
+	if c.Auth != nil {
+		return c.Auth.Authenticate(r)
+	}
+	return nil, "", nil
+}
+
+// requestToken looks for the token in the query, the Authorization header and
+// the offered subprotocols, in that order.
+func requestToken(r *http.Request) (string, string) {
+	if token := r.URL.Query().Get(TokenParam); token != "" {
+		return token, ""
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), ""
+	}
+	var token, other string
+	for _, header := range r.Header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(header, ",") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, TokenProtocolPrefix) {
+				token = p
+			} else if other == "" && p != "" {
+				other = p
+			}
+		}
+	}
+	if token == "" {
+		return "", ""
+	}
+	// the browser fails the handshake unless one offered protocol is accepted
+	if other == "" {
+		other = token
+	}
+	return strings.TrimPrefix(token, TokenProtocolPrefix), other
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Tenant    string      `json:"tenant"`
+	Roles     []string    `json:"roles"`
+	Listen    []string    `json:"listen"`
+	Connect   []string    `json:"connect"`
+	Issuer    string      `json:"iss"`
+	Audience  interface{} `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+func (c *jwtClaims) hasAudience(audience string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verify checks the signature and the registered claims of a compact JWT.
+func (a *Authenticator) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "token signature")
+	}
+	if err := a.verifySignature(header, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var raw jwtClaims
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, errors.Wrap(err, "token claims")
+	}
+	now := time.Now()
+	claims := &Claims{Subject: raw.Subject, Tenant: raw.Tenant, Roles: raw.Roles, Listen: raw.Listen, Connect: raw.Connect}
+	if raw.ExpiresAt != nil {
+		claims.ExpiresAt = unixTime(*raw.ExpiresAt)
+		if now.After(claims.ExpiresAt.Add(a.config.Leeway)) {
+			return nil, errTokenExpired
+		}
+	}
+	if raw.NotBefore != nil && now.Add(a.config.Leeway).Before(unixTime(*raw.NotBefore)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if a.config.Issuer != "" && raw.Issuer != a.config.Issuer {
+		return nil, errors.Errorf("unexpected issuer %q", raw.Issuer)
+	}
+	if a.config.Audience != "" && !raw.hasAudience(a.config.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	claims.applyPolicy(a.config.Policy)
+	return claims, nil
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+func (a *Authenticator) verifySignature(header jwtHeader, signed string, sig []byte) error {
+	var hash crypto.Hash
+	if len(header.Alg) == 5 && strings.Contains("HS RS PS ES", header.Alg[:2]) {
+		hash = jwtHashes[header.Alg[2:]]
+	}
+	if hash == 0 {
+		return errors.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	for _, k := range a.candidates(header.Kid) {
+		switch key := k.key.(type) {
+		case []byte:
+			if strings.HasPrefix(header.Alg, "HS") {
+				mac := hmac.New(hash.New, key)
+				mac.Write([]byte(signed))
+				if hmac.Equal(mac.Sum(nil), sig) {
+					return nil
+				}
+			}
+		case *rsa.PublicKey:
+			if strings.HasPrefix(header.Alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+				return nil
+			}
+			if strings.HasPrefix(header.Alg, "PS") && rsa.VerifyPSS(key, hash, digest, sig, nil) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if strings.HasPrefix(header.Alg, "ES") && len(sig) == 2*size {
+				r := new(big.Int).SetBytes(sig[:size])
+				s := new(big.Int).SetBytes(sig[size:])
+				if ecdsa.Verify(key, digest, r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// candidates are the keys with the given id, or all keys without an id.
+func (a *Authenticator) candidates(kid string) []verificationKey {
+	var keys []verificationKey
+	for id, secret := range a.config.Secrets {
+		if kid == "" || kid == id {
+			keys = append(keys, verificationKey{id: id, key: secret})
+		}
+	}
+	for _, k := range a.jwks() {
+		if kid == "" || kid == k.id {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// jwks returns the keys of the JWKS file, reloading it if it changed. A file
+// that fails to load keeps the previous keys.
+func (a *Authenticator) jwks() []verificationKey {
+	if a.config.JWKSFile == "" {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if time.Since(a.jwksChecked) >= jwksCheckInterval {
+		a.jwksChecked = time.Now()
+		if info, err := os.Stat(a.config.JWKSFile); err == nil && !info.ModTime().Equal(a.jwksModTime) {
+			a.loadJWKS()
+		}
+	}
+	return a.keys
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// loadJWKS must be called with a.mu locked or before a is shared.
+func (a *Authenticator) loadJWKS() error {
+	info, err := os.Stat(a.config.JWKSFile)
+	if err != nil {
+		return errors.Wrap(err, "jwks")
+	}
+	b, err := ioutil.ReadFile(a.config.JWKSFile)
+	if err != nil {
+		return errors.Wrap(err, "jwks")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return errors.Wrap(err, "jwks")
+	}
+	keys := make([]verificationKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return errors.Wrapf(err, "jwks key %q", k.Kid)
+		}
+		keys = append(keys, verificationKey{id: k.Kid, key: key})
+	}
+	a.keys = keys
+	a.jwksModTime = info.ModTime()
+	return nil
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "oct":
+		return decode(k.K)
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curve, ok := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[k.Crv]
+		if !ok {
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, errors.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,202 @@
+package signalsrv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func jsonSegment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return b64(b)
+}
+
+// signToken signs claims with an []byte HMAC secret, an RSA or an EC key.
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := jsonSegment(header) + "." + jsonSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	b, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	defer func(d time.Duration) { jwksCheckInterval = d }(jwksCheckInterval)
+	jwksCheckInterval = 0
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	jwks := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwks, map[string]string{
+		"kty": "RSA", "kid": "rsa1",
+		"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+	})
+
+	auth, err := NewAuthenticator(AuthConfig{
+		Secrets:  map[string][]byte{"old": []byte("old-secret"), "new": []byte("new-secret")},
+		JWKSFile: jwks,
+		Issuer:   "https://id.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	claims := map[string]interface{}{"sub": "alice", "tenant": "acme", "roles": []string{"host"}, "iss": "https://id.example.com", "exp": exp}
+
+	for name, token := range map[string]string{
+		"hmac":         signToken(t, "HS256", "", []byte("old-secret"), claims),
+		"hmac with id": signToken(t, "HS256", "new", []byte("new-secret"), claims),
+		"rsa":          signToken(t, "RS256", "rsa1", rsaKey, claims),
+	} {
+		got, err := auth.Verify(token)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got.Subject != "alice" || got.Tenant != "acme" || len(got.Roles) != 1 || got.ExpiresAt.Unix() != int64(exp) {
+			t.Errorf("%s: unexpected claims %+v", name, got)
+		}
+	}
+
+	expired := map[string]interface{}{"sub": "alice", "iss": "https://id.example.com", "exp": float64(time.Now().Add(-time.Minute).Unix())}
+	wrongIssuer := map[string]interface{}{"sub": "alice", "iss": "https://evil.com"}
+	for name, token := range map[string]string{
+		"wrong secret":    signToken(t, "HS256", "", []byte("guess"), claims),
+		"wrong key id":    signToken(t, "HS256", "new", []byte("old-secret"), claims),
+		"expired":         signToken(t, "HS256", "", []byte("old-secret"), expired),
+		"wrong issuer":    signToken(t, "HS256", "", []byte("old-secret"), wrongIssuer),
+		"unsigned":        jsonSegment(map[string]string{"alg": "none"}) + "." + jsonSegment(claims) + ".",
+		"unknown ec key":  signToken(t, "ES256", "ec1", ecKey, claims),
+		"rsa key as hmac": signToken(t, "HS256", "rsa1", rsaKey.N.Bytes(), claims),
+		"malformed":       "abc",
+	} {
+		if _, err := auth.Verify(token); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+
+	// rotate the JWKS, the new key is picked up and the removed one rejected
+	writeJWKS(t, jwks, map[string]string{
+		"kty": "EC", "kid": "ec1", "crv": "P-256",
+		"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()),
+	})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(jwks, later, later)
+	if _, err := auth.Verify(signToken(t, "ES256", "ec1", ecKey, claims)); err != nil {
+		t.Errorf("expected the rotated key to verify got: %v", err)
+	}
+	if _, err := auth.Verify(signToken(t, "RS256", "rsa1", rsaKey, claims)); err == nil {
+		t.Error("expected the removed key to be rejected")
+	}
+}
+
+func TestAuthUpgrade(t *testing.T) {
+	auth, err := NewAuthenticator(AuthConfig{Secrets: map[string][]byte{"": []byte("secret")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Auth: auth})
+	defer closeServer()
+	token := signToken(t, "HS256", "", []byte("secret"), map[string]interface{}{"sub": "alice", "tenant": "acme"})
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected an upgrade without a token to be rejected")
+	}
+	if want, got := http.StatusUnauthorized, resp.StatusCode; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	bad := signToken(t, "HS256", "", []byte("guess"), map[string]interface{}{"sub": "mallory"})
+	if _, _, err := websocket.DefaultDialer.Dial(url+"?token="+bad, nil); err == nil {
+		t.Error("expected an upgrade with a bad token to be rejected")
+	}
+
+	c := dialTestClient(t, url+"?token="+token)
+	c.send(t, NetEventTypeServerInitialized, -1, "room")
+	c.expect(t, NetEventTypeServerInitialized)
+	c.conn.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"awsignal", TokenProtocolPrefix + token}}
+	conn, _, err = dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if want, got := "awsignal", conn.Subprotocol(); want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	var info PeerInfo
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		infos := testPeers(wns, "Test", "")
+		if len(infos) == 1 {
+			info = infos[0]
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.User != "alice" || info.Tenant != "acme" {
+		t.Errorf("expected the claims on the peer got: %+v", info)
+	}
+}
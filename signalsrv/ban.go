@@ -0,0 +1,233 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BanKind is what a ban matches.
+type BanKind string
+
+const (
+	// BanIP matches the client IP by a single IP or a CIDR range.
+	BanIP BanKind = "ip"
+	// BanUser matches the subject claim, * matches any run of characters.
+	BanUser BanKind = "user"
+	// BanAddress matches the addresses peers listen on or connect to, *
+	// matches any run of characters.
+	BanAddress BanKind = "address"
+)
+
+// RejectBanned is the reason counted for upgrades that match a ban.
+const RejectBanned = "banned"
+
+// Ban blocks an IP, user or address of an app, or of every app if App is
+// empty, until it expires.
+type Ban struct {
+	ID        uint64     `json:"id"`
+	Kind      BanKind    `json:"kind"`
+	Value     string     `json:"value"`
+	App       string     `json:"app,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	network *net.IPNet
+}
+
+func (b *Ban) parse() error {
+	switch b.Kind {
+	case BanIP:
+		network, err := parseCIDR(b.Value)
+		if err != nil {
+			return err
+		}
+		b.network = network
+	case BanUser, BanAddress:
+	default:
+		return errors.Errorf("unknown ban kind %q", b.Kind)
+	}
+	if b.Value == "" {
+		return errors.New("missing ban value")
+	}
+	return nil
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+func (b *Ban) matches(app string, kind BanKind, value string) bool {
+	if b.Kind != kind || (b.App != "" && b.App != app) {
+		return false
+	}
+	if kind == BanIP {
+		ip := net.ParseIP(value)
+		return ip != nil && b.network.Contains(ip)
+	}
+	return anyClaims.match(b.Value, value)
+}
+
+// BanList holds the bans of a server. With a file it loads the bans on start
+// and writes them back on every change, expired bans are dropped then.
+type BanList struct {
+	file   string
+	mu     sync.Mutex
+	bans   []*Ban
+	nextID uint64
+}
+
+// NewBanList loads the bans of file, a missing file is an empty list. An
+// empty file name keeps the bans in memory only.
+func NewBanList(file string) (*BanList, error) {
+	l := &BanList{file: file, nextID: 1}
+	if file == "" {
+		return l, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ban list")
+	}
+	var bans []*Ban
+	if err := json.Unmarshal(b, &bans); err != nil {
+		return nil, errors.Wrapf(err, "ban list %s", file)
+	}
+	now := time.Now()
+	for _, ban := range bans {
+		if err := ban.parse(); err != nil {
+			return nil, errors.Wrapf(err, "ban list %s: ban %d", file, ban.ID)
+		}
+		if ban.ID >= l.nextID {
+			l.nextID = ban.ID + 1
+		}
+		if !ban.expired(now) {
+			l.bans = append(l.bans, ban)
+		}
+	}
+	return l, nil
+}
+
+// Add validates ban, gives it an ID and stores it. A zero ttl never expires.
+func (l *BanList) Add(ban Ban, ttl time.Duration) (Ban, error) {
+	if err := ban.parse(); err != nil {
+		return Ban{}, err
+	}
+	ban.CreatedAt = time.Now()
+	if ttl > 0 {
+		expires := ban.CreatedAt.Add(ttl)
+		ban.ExpiresAt = &expires
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ban.ID = l.nextID
+	l.nextID++
+	l.bans = append(l.bans, &ban)
+	return ban, l.save()
+}
+
+// Remove deletes the ban with id, it returns false if there is none.
+func (l *BanList) Remove(id uint64) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ban := range l.bans {
+		if ban.ID == id {
+			l.bans = append(l.bans[:i], l.bans[i+1:]...)
+			return true, l.save()
+		}
+	}
+	return false, nil
+}
+
+// List returns the bans that haven't expired, ordered by ID.
+func (l *BanList) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bans := make([]Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if !ban.expired(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].ID < bans[j].ID })
+	return bans
+}
+
+// match returns the first ban of the app of the given kind that matches
+// value, nil if there is none.
+func (l *BanList) match(app string, kind BanKind, value string) *Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for _, ban := range l.bans {
+		if !ban.expired(now) && ban.matches(app, kind, value) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// save must be called with l.mu locked. The file is replaced atomically, so
+// a crash never leaves half a list behind.
+func (l *BanList) save() error {
+	if l.file == "" {
+		return nil
+	}
+	now := time.Now()
+	bans := make([]*Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	l.bans = bans
+	b, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "ban list")
+	}
+	return errors.Wrap(os.Rename(tmp, l.file), "ban list")
+}
+
+// banned counts and logs a ban that matches the upgrade request, it returns
+// false if there is none.
+func (wns *WebsocketNetworkServer) banned(r *http.Request, app string, kind BanKind, value string) bool {
+	ban := wns.bans.match(app, kind, value)
+	if ban == nil {
+		return false
+	}
+	wns.metrics.countBanned(app, kind)
+	wns.metrics.countReject(app, RejectBanned)
+	wns.log(LevelWarn, "upgrade banned", F("app", app), F("remote", r.RemoteAddr), F("kind", kind), F("ban", ban.ID))
+	return true
+}
+
+// bannedAddress counts and logs a ban of address, it returns false if there
+// is none.
+func (sp *SignalingPeer) bannedAddress(address string) bool {
+	server := sp.connectionPool.server
+	if server == nil {
+		return false
+	}
+	ban := server.bans.match(sp.app(), BanAddress, address)
+	if ban == nil {
+		return false
+	}
+	sp.connectionPool.metrics.countBanned(sp.app(), BanAddress)
+	sp.logScoped(LevelWarn, address, "address banned", F("ban", ban.ID))
+	return true
+}
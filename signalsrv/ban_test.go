@@ -0,0 +1,164 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "bans.json")
+
+	l, err := NewBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ban := range []Ban{
+		{Kind: "nope", Value: "x"},
+		{Kind: BanIP, Value: "10.0.0.0/33"},
+		{Kind: BanUser},
+	} {
+		if _, err := l.Add(ban, 0); err == nil {
+			t.Errorf("expected %+v to be invalid", ban)
+		}
+	}
+	subnet, _ := l.Add(Ban{Kind: BanIP, Value: "10.1.0.0/16"}, 0)
+	l.Add(Ban{Kind: BanIP, Value: "::1", App: "Other"}, 0)
+	l.Add(Ban{Kind: BanUser, Value: "*@spam.example"}, time.Hour)
+	l.Add(Ban{Kind: BanAddress, Value: "scam:*"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	l, err = NewBanList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		kind  BanKind
+		value string
+		want  bool
+	}{
+		{BanIP, "10.1.2.3", true},
+		{BanIP, "10.2.0.1", false},
+		{BanIP, "::1", false},
+		{BanUser, "bob@spam.example", true},
+		{BanUser, "bob@example.com", false},
+		{BanAddress, "scam:1", false},
+	}
+	for _, test := range tests {
+		if want, got := test.want, l.match("Test", test.kind, test.value) != nil; want != got {
+			t.Errorf("expected %v for %s %s got: %v", want, test.kind, test.value, got)
+		}
+	}
+	if l.match("Other", BanIP, "::1") == nil {
+		t.Error("expected the ban of the other app to match")
+	}
+	if want, got := 3, len(l.List()); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+
+	if ok, err := l.Remove(subnet.ID); !ok || err != nil {
+		t.Fatalf("expected ban %d to be removed got: %v %v", subnet.ID, ok, err)
+	}
+	if ok, _ := l.Remove(subnet.ID); ok {
+		t.Error("expected a removed ban to be gone")
+	}
+	l, _ = NewBanList(file)
+	if l.match("Test", BanIP, "10.1.2.3") != nil {
+		t.Error("expected the removal to be saved")
+	}
+	if ban, _ := l.Add(Ban{Kind: BanUser, Value: "eve"}, 0); ban.ID <= subnet.ID {
+		t.Errorf("expected ids not to be reused got: %d", ban.ID)
+	}
+}
+
+func TestBans(t *testing.T) {
+	auth, err := NewAuthenticator(AuthConfig{Secrets: map[string][]byte{"": []byte("secret")}, Optional: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans, _ := NewBanList("")
+	wns, url, closeServer := newTestServer(t, &ServerConfig{Bans: bans}, &AppConfig{Path: "/", AppName: "Test", Auth: auth})
+	defer closeServer()
+
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	bans.Add(Ban{Kind: BanAddress, Value: "scam:*"}, 0)
+	c.send(t, NetEventTypeServerInitialized, -1, "scam:lobby")
+	c.expect(t, NetEventTypeServerInitFailed)
+	c.send(t, NetEventTypeNewConnection, 1, "scam:lobby")
+	c.expect(t, NetEventTypeConnectionFailed)
+	c.send(t, NetEventTypeServerInitialized, -1, "lobby")
+	c.expect(t, NetEventTypeServerInitialized)
+
+	token := signToken(t, "HS256", "", []byte("secret"), map[string]interface{}{"sub": "mallory"})
+	bans.Add(Ban{Kind: BanUser, Value: "mallory"}, 0)
+	if _, status := dialStatus(t, url+"?token="+token); status != http.StatusForbidden {
+		t.Errorf("expected %d got: %d", http.StatusForbidden, status)
+	}
+	ipBan, _ := bans.Add(Ban{Kind: BanIP, Value: "127.0.0.0/8"}, 0)
+	if _, status := dialStatus(t, url); status != http.StatusForbidden {
+		t.Errorf("expected %d got: %d", http.StatusForbidden, status)
+	}
+	bans.Remove(ipBan.ID)
+	conn, status := dialStatus(t, url)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected %d got: %d", http.StatusSwitchingProtocols, status)
+	}
+	conn.Close()
+
+	text := metricsText(wns)
+	for _, want := range []string{
+		`awsignal_banned_total{app="Test",kind="address"} 2`,
+		`awsignal_banned_total{app="Test",kind="user"} 1`,
+		`awsignal_banned_total{app="Test",kind="ip"} 1`,
+		`awsignal_rejected_upgrades_total{app="Test",reason="banned"} 2`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected metrics to contain %q got:\n%s", want, text)
+		}
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	api, _, _ := newTestAdmin(t)
+	form := url.Values{"kind": {"ip"}, "value": {"192.0.2.0/24"}, "ttl": {"1h"}, "reason": {"abuse"}}
+	if want, got := http.StatusOK, adminPost(api, "/api/bans", form); want != got {
+		t.Fatalf("expected %d got: %d", want, got)
+	}
+	if want, got := http.StatusBadRequest, adminPost(api, "/api/bans", url.Values{"kind": {"ip"}, "value": {"nope"}}); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	var bans []Ban
+	adminGet(api, "/api/bans", "secret", &bans)
+	if len(bans) != 1 || bans[0].Reason != "abuse" || bans[0].ExpiresAt == nil {
+		t.Fatalf("expected the ban got: %+v", bans)
+	}
+
+	del := func(id uint64) int {
+		r := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/api/bans/%d", id), nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w.Code
+	}
+	if want, got := http.StatusOK, del(bans[0].ID); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := http.StatusNotFound, del(bans[0].ID); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	var page json.RawMessage
+	adminGet(api, "/api/bans", "secret", &page)
+	if want, got := "[]", strings.TrimSpace(string(page)); want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+}
@@ -0,0 +1,107 @@
+package signalsrv
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var errNoClientCert = errors.New("no client certificate")
+
+type ClientCertConfig struct {
+	// CAFile is the PEM bundle client certificates have to chain to.
+	CAFile string
+	// Identities map certificates to peers, the first match wins. A
+	// certificate without a matching identity gets its common name as
+	// subject and no privileges.
+	Identities []CertIdentity
+	// Required rejects upgrades without a certificate, otherwise they are
+	// authenticated by the app's Auth if it has one.
+	Required bool
+}
+
+// CertIdentity is the identity and privileges of the peers whose certificate
+// matches Subject.
+type CertIdentity struct {
+	// Subject is matched against the common name and the DNS and URI names
+	// of the certificate, * matches any run of characters.
+	Subject string   `json:"subject"`
+	Tenant  string   `json:"tenant,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	// Listen and Connect are address patterns as in Policy.
+	Listen  []string `json:"listen,omitempty"`
+	Connect []string `json:"connect,omitempty"`
+	// Reserved allows listening on the app's ReservedAddresses.
+	Reserved bool `json:"reserved,omitempty"`
+}
+
+// ClientCertAuth authenticates upgrades by the client certificate of the TLS
+// connection. The server only requests certificates, each app verifies them
+// against its own CA bundle.
+type ClientCertAuth struct {
+	config ClientCertConfig
+	roots  *x509.CertPool
+}
+
+func NewClientCertAuth(config ClientCertConfig) (*ClientCertAuth, error) {
+	b, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "client ca")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("client ca %s: no certificates", config.CAFile)
+	}
+	return &ClientCertAuth{config: config, roots: roots}, nil
+}
+
+// Authenticate verifies the client certificate of r. It returns nil claims
+// and no error if there is no certificate and it isn't required.
+func (a *ClientCertAuth) Authenticate(r *http.Request) (*Claims, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		if a.config.Required {
+			return nil, errNoClientCert
+		}
+		return nil, nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "client certificate")
+	}
+	return a.claims(cert), nil
+}
+
+func (a *ClientCertAuth) claims(cert *x509.Certificate) *Claims {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, id := range a.config.Identities {
+		for _, name := range names {
+			if name != "" && anyClaims.match(id.Subject, name) {
+				return &Claims{
+					Subject:  name,
+					Tenant:   id.Tenant,
+					Roles:    id.Roles,
+					Listen:   id.Listen,
+					Connect:  id.Connect,
+					Reserved: id.Reserved,
+				}
+			}
+		}
+	}
+	// empty patterns allow nothing, unlike nil ones
+	return &Claims{Subject: cert.Subject.CommonName, Listen: []string{}, Connect: []string{}}
+}
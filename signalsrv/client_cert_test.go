@@ -0,0 +1,115 @@
+package signalsrv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func certDialer(cert *x509.Certificate, key *ecdsa.PrivateKey) *websocket.Dialer {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+	}
+	return &websocket.Dialer{TLSClientConfig: config}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca, caKey := testCert(t, "Test CA", 1, nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := testCert(t, "localhost", 2, ca, caKey)
+	certFile, keyFile := writeCert(t, dir, "server", serverCert, serverKey)
+	recorder, recorderKey := testCert(t, "recorder.example.com", 3, ca, caKey)
+	client, clientKey := testCert(t, "client.example.com", 4, ca, caKey)
+	otherCA, otherCAKey := testCert(t, "Other CA", 5, nil, nil)
+	stranger, strangerKey := testCert(t, "recorder.evil.com", 6, otherCA, otherCAKey)
+
+	certs, err := NewClientCertAuth(ClientCertConfig{
+		CAFile:     caFile,
+		Identities: []CertIdentity{{Subject: "recorder.*", Roles: []string{"bot"}, Reserved: true}},
+		Required:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuthenticator(AuthConfig{Secrets: map[string][]byte{"": []byte("secret")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps := map[string]*AppConfig{
+		"/services": {Path: "/services", AppName: "Services", ClientCerts: certs, ReservedAddresses: []string{"recorder:*"}},
+		"/tokens":   {Path: "/tokens", AppName: "Tokens", Auth: auth},
+	}
+	config, err := NewTLSConfig(TLSOptions{CertFile: certFile, KeyFile: keyFile, RequestClientCerts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wns := NewWebsocketNetworkServer(nil)
+	defer wns.Shutdown(context.Background())
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wns.HandleUpgrade(w, r, apps[r.URL.Path])
+	}))
+	ts.Listener = tls.NewListener(ts.Listener, config)
+	ts.Start()
+	defer ts.Close()
+	url := "wss" + strings.TrimPrefix(ts.URL, "http")
+
+	bot := dialTestClientWith(t, certDialer(recorder, recorderKey), url+"/services")
+	defer bot.conn.Close()
+	bot.send(t, NetEventTypeServerInitialized, -1, "recorder:room1")
+	bot.expect(t, NetEventTypeServerInitialized)
+
+	c := dialTestClientWith(t, certDialer(client, clientKey), url+"/services")
+	defer c.conn.Close()
+	c.send(t, NetEventTypeServerInitialized, -1, "recorder:room2")
+	c.expect(t, NetEventTypeServerInitFailed)
+	// without a matching identity the certificate grants nothing
+	c.send(t, NetEventTypeServerInitialized, -1, "room2")
+	c.expect(t, NetEventTypeServerInitFailed)
+	c.send(t, NetEventTypeNewConnection, 1, "recorder:room1")
+	c.expect(t, NetEventTypeConnectionFailed)
+
+	if infos := testPeers(wns, "Services", "recorder:"); len(infos) != 1 || infos[0].User != "recorder.example.com" {
+		t.Errorf("expected the recorder identity got: %+v", infos)
+	}
+
+	for name, dialer := range map[string]*websocket.Dialer{
+		"no certificate":    certDialer(nil, nil),
+		"other certificate": certDialer(stranger, strangerKey),
+	} {
+		_, resp, err := dialer.Dial(url+"/services", nil)
+		if err == nil {
+			t.Errorf("%s: expected the upgrade to be rejected", name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d got: %v", name, http.StatusUnauthorized, err)
+		}
+	}
+
+	// the token app on the same listener doesn't ask for a certificate
+	if _, _, err := certDialer(nil, nil).Dial(url+"/tokens", nil); err == nil {
+		t.Error("expected the token app to require a token")
+	}
+	token := signToken(t, "HS256", "", []byte("secret"), map[string]interface{}{"sub": "alice"})
+	user := dialTestClientWith(t, certDialer(nil, nil), url+"/tokens?token="+token)
+	defer user.conn.Close()
+	user.send(t, NetEventTypeServerInitialized, -1, "room")
+	user.expect(t, NetEventTypeServerInitialized)
+}
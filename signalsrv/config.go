@@ -1,7 +1,71 @@
 package signalsrv
 
+import (
+	"net"
+	"time"
+)
+
 type AppConfig struct {
 	Path           string
 	AppName        string
 	AddressSharing bool
+	// ShareRTT sends the keepalive RTT of a peer in a shared room to the
+	// other peers of the room as a Log event.
+	ShareRTT bool
+	// AllowedOrigins are the origins allowed to upgrade, either exact like
+	// "https://app.example.com", with a wildcard subdomain like
+	// "https://*.example.com" or "*". Empty only allows the request host.
+	AllowedOrigins []string
+	// AllowMissingOrigin accepts clients without an Origin header, like
+	// native clients, when AllowedOrigins is set.
+	AllowMissingOrigin bool
+	// Auth verifies the token of every upgrade request, nil lets anyone in.
+	Auth *Authenticator
+	// ClientCerts verifies the TLS client certificate of upgrade requests.
+	// Peers with a valid certificate don't need a token.
+	ClientCerts *ClientCertAuth
+	// ReservedAddresses are address patterns only peers with the reserved
+	// privilege of a CertIdentity may listen on, like "recorder:*".
+	ReservedAddresses []string
+	// Limits are the rate limits per peer and per IP, nil disables them.
+	Limits *RateLimits
+	// KnockToJoin sends the listener a join request for every connector,
+	// they are only linked once the listener accepts it.
+	KnockToJoin bool
+	// KnockTimeout rejects join requests the listener didn't answer in time,
+	// it defaults to 30 seconds.
+	KnockTimeout time.Duration
+}
+
+type ServerConfig struct {
+	ReadBufferSize  int
+	WriteBufferSize int
+	// LowMemory shares write buffers between peers, reuses the small
+	// handshake read buffer and only runs a writer goroutine while a peer has
+	// queued events.
+	LowMemory bool
+	// Netpoll additionally replaces the per-peer reader goroutine with a
+	// single epoll loop. It requires LowMemory and is only supported on linux.
+	Netpoll bool
+	// Logger defaults to a text logger on stderr.
+	Logger Logger
+	// Verbosity defaults to LevelInfo without payloads.
+	Verbosity *Verbosity
+	// Tracer records spans of the signaling flows, nil disables tracing.
+	Tracer *Tracer
+	// TracePropagation continues the trace of the client given by the
+	// traceparent query parameter of the handshake.
+	TracePropagation bool
+	// Recorder records the events of selected apps and addresses, nil
+	// disables recording.
+	Recorder *Recorder
+	// MaxPeers and MaxGoroutines are load-shedding thresholds, readiness
+	// fails while they are exceeded. Zero disables a threshold.
+	MaxPeers      int
+	MaxGoroutines int
+	// Bans defaults to an empty list that isn't persisted.
+	Bans *BanList
+	// TrustedProxies are the load balancers whose Forwarded and
+	// X-Forwarded-For headers name the client, see ParseCIDRs.
+	TrustedProxies []*net.IPNet
 }
@@ -0,0 +1,155 @@
+package signalsrv
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Build information, set at link time with
+// -ldflags "-X github.com/huaishan/awsignal/signalsrv.Version=...".
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+var healthTimeout = time.Second
+
+// tryLock reports whether l could be locked within timeout. On a timeout the
+// lock is still taken and released later, so a slow holder is not disturbed.
+func tryLock(l sync.Locker, timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+		l.Unlock()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-locked:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Drain marks the server as not ready, so load balancers stop sending new
+// upgrades while the existing peers are still served. Shutdown drains too.
+func (wns *WebsocketNetworkServer) Drain() {
+	if atomic.CompareAndSwapInt32(&wns.draining, 0, 1) {
+		wns.log(LevelInfo, "draining")
+	}
+}
+
+func (wns *WebsocketNetworkServer) isDraining() bool {
+	return atomic.LoadInt32(&wns.draining) == 1
+}
+
+// liveness checks that the pools can be locked, i.e. events are routed, and
+// that the shared pinger and netpoll loops still run.
+func (wns *WebsocketNetworkServer) liveness() map[string]string {
+	checks := make(map[string]string)
+	check := func(name string, ok bool) {
+		if ok {
+			checks[name] = "ok"
+		} else {
+			checks[name] = "unresponsive"
+		}
+	}
+	if !tryLock(&wns.mu, healthTimeout) {
+		check("server", false)
+		return checks
+	}
+	pools := true
+	for _, pp := range wns.pools() {
+		pools = pools && tryLock(&pp.mu, healthTimeout)
+	}
+	check("pools", pools)
+	if wns.ctx.Err() == nil {
+		if wns.pinger != nil {
+			check("pinger", wns.pinger.responsive(healthTimeout))
+		}
+		if wns.poller != nil {
+			check("netpoll", wns.poller.responsive(healthTimeout))
+		}
+	}
+	return checks
+}
+
+// readiness lists the reasons not to send new upgrades to this server.
+func (wns *WebsocketNetworkServer) readiness() []string {
+	reasons := make([]string, 0)
+	if wns.isDraining() {
+		reasons = append(reasons, "shutting down")
+	}
+	if max := wns.config.MaxPeers; max > 0 {
+		peers := 0
+		for _, pp := range wns.pools() {
+			pp.mu.Lock()
+			peers += pp.count()
+			pp.mu.Unlock()
+		}
+		if peers >= max {
+			reasons = append(reasons, "too many peers")
+		}
+	}
+	if max := wns.config.MaxGoroutines; max > 0 && runtime.NumGoroutine() >= max {
+		reasons = append(reasons, "too many goroutines")
+	}
+	return reasons
+}
+
+// Liveness serves /healthz, it fails if the event loops stopped responding.
+func (wns *WebsocketNetworkServer) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks := wns.liveness()
+		status := http.StatusOK
+		for _, v := range checks {
+			if v != "ok" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, status, map[string]interface{}{"status": http.StatusText(status), "checks": checks})
+	})
+}
+
+// Readiness serves /readyz, it fails once shutdown began or while a
+// load-shedding threshold is exceeded.
+func (wns *WebsocketNetworkServer) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reasons := wns.readiness()
+		status := http.StatusOK
+		if len(reasons) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]interface{}{"status": http.StatusText(status), "reasons": reasons})
+	})
+}
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	Module    string `json:"module,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path + "@" + bi.Main.Version
+	}
+	return info
+}
+
+// VersionHandler serves /version.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ReadBuildInfo())
+	})
+}
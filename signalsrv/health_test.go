@@ -0,0 +1,105 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(h http.Handler, v interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if v != nil {
+		json.Unmarshal(w.Body.Bytes(), v)
+	}
+	return w.Code
+}
+
+func TestLiveness(t *testing.T) {
+	defer func(d time.Duration) { healthTimeout = d }(healthTimeout)
+	healthTimeout = 50 * time.Millisecond
+
+	for mode, config := range testModes {
+		t.Run(mode, func(t *testing.T) {
+			wns, url, closeServer := newTestServer(t, config, &AppConfig{Path: "/", AppName: "Test"})
+			defer closeServer()
+			c := dialTestClient(t, url)
+			defer c.conn.Close()
+			c.send(t, NetEventTypeServerInitialized, -1, "room")
+			c.expect(t, NetEventTypeServerInitialized)
+
+			var body struct{ Checks map[string]string }
+			if want, got := http.StatusOK, probe(wns.Liveness(), &body); want != got {
+				t.Fatalf("expected %d got: %d %v", want, got, body.Checks)
+			}
+
+			pool := testPool(wns, "Test")
+			pool.mu.Lock()
+			got := probe(wns.Liveness(), &body)
+			pool.mu.Unlock()
+			if want := http.StatusServiceUnavailable; want != got {
+				t.Errorf("expected %d got: %d", want, got)
+			}
+			if want, got := "unresponsive", body.Checks["pools"]; want != got {
+				t.Errorf("expected %s got: %s", want, got)
+			}
+		})
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, &ServerConfig{MaxPeers: 2}, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+
+	var body struct{ Reasons []string }
+	if want, got := http.StatusOK, probe(wns.Readiness(), &body); want != got {
+		t.Fatalf("expected %d got: %d %v", want, got, body.Reasons)
+	}
+
+	for i := 0; i < 2; i++ {
+		c := dialTestClient(t, url)
+		defer c.conn.Close()
+		c.send(t, NetEventTypeServerInitialized, -1, string(rune('a'+i)))
+		c.expect(t, NetEventTypeServerInitialized)
+	}
+	if want, got := http.StatusServiceUnavailable, probe(wns.Readiness(), &body); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := []string{"too many peers"}, body.Reasons; len(got) != 1 || want[0] != got[0] {
+		t.Errorf("expected %v got: %v", want, got)
+	}
+
+	wns.config.MaxPeers = 0
+	if want, got := http.StatusOK, probe(wns.Readiness(), nil); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	wns.Drain()
+	if want, got := http.StatusServiceUnavailable, probe(wns.Readiness(), &body); want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := "shutting down", body.Reasons[0]; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	// draining keeps serving upgrades until Shutdown
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	c.send(t, NetEventTypeServerInitialized, -1, "c")
+	c.expect(t, NetEventTypeServerInitialized)
+}
+
+func TestVersion(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "v1.2.3"
+	var info BuildInfo
+	if want, got := http.StatusOK, probe(VersionHandler(), &info); want != got {
+		t.Fatalf("expected %d got: %d", want, got)
+	}
+	if want, got := "v1.2.3", info.Version; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if info.GoVersion == "" {
+		t.Error("expected a go version")
+	}
+}
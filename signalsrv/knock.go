@@ -0,0 +1,164 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"time"
+)
+
+var defaultKnockTimeout = 30 * time.Second
+
+// Results of join requests.
+const (
+	KnockAccepted  = "accepted"
+	KnockRejected  = "rejected"
+	KnockTimeout   = "timeout"
+	KnockCancelled = "cancelled"
+)
+
+// JoinRequest tells the listener of an app with KnockToJoin about a
+// connector. It arrives as a Log event whose connection id is the one the
+// connector gets once the listener accepts by sending a NewConnection event
+// with that id and no address. A ConnectionFailed event with the id rejects
+// it. The listener is just another client, so the request leaves out the
+// connector's IP.
+type JoinRequest struct {
+	Address string `json:"address"`
+	Peer    PeerId `json:"peer"`
+	User    string `json:"user,omitempty"`
+	Tenant  string `json:"tenant,omitempty"`
+	// Meta is the meta parameter of the connector's address.
+	Meta string `json:"meta,omitempty"`
+}
+
+// joinNotice is the payload of the Log events about join requests, a
+// request is cancelled when it times out or the connector gives up.
+type joinNotice struct {
+	Request   *JoinRequest `json:"join_request,omitempty"`
+	Cancelled string       `json:"join_cancelled,omitempty"`
+}
+
+// knock is a pending join request, it is guarded by the pool lock.
+type knock struct {
+	address     string
+	connector   *SignalingPeer
+	connectorId *ConnectionId
+	listener    *SignalingPeer
+	listenerId  *ConnectionId
+	timer       *time.Timer
+}
+
+// knock asks listener to let the peer in with connection id. The pool must be
+// locked.
+func (sp *SignalingPeer) knock(listener *SignalingPeer, id *ConnectionId, address, meta string) {
+	if k := sp.knocking[id.ID]; k != nil {
+		k.cancel()
+	}
+	k := &knock{
+		address:     address,
+		connector:   sp,
+		connectorId: id,
+		listener:    listener,
+		listenerId:  listener.nextConnectionId(),
+	}
+	if sp.knocking == nil {
+		sp.knocking = make(map[int16]*knock)
+	}
+	if listener.knocks == nil {
+		listener.knocks = make(map[int16]*knock)
+	}
+	sp.knocking[id.ID] = k
+	listener.knocks[k.listenerId.ID] = k
+
+	request := &JoinRequest{Address: address, Peer: sp.id, Meta: meta}
+	if sp.claims != nil {
+		request.User = sp.claims.Subject
+		request.Tenant = sp.claims.Tenant
+	}
+	listener.notifyJoin(k.listenerId, joinNotice{Request: request})
+
+	timeout := sp.connectionPool.appConfig.KnockTimeout
+	if timeout <= 0 {
+		timeout = defaultKnockTimeout
+	}
+	pool := sp.connectionPool
+	k.timer = time.AfterFunc(timeout, func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		if listener.knocks[k.listenerId.ID] == k {
+			k.finish(KnockTimeout)
+			k.refuse("join request timed out")
+			listener.notifyJoin(k.listenerId, joinNotice{Cancelled: KnockTimeout})
+		}
+	})
+}
+
+func (sp *SignalingPeer) notifyJoin(id *ConnectionId, notice joinNotice) {
+	b, err := json.Marshal(notice)
+	if err != nil {
+		return
+	}
+	text := string(b)
+	sp.sendToClient(NewNetworkEvent(NetEventTypeLog, id, &NetEventData{Type: NetEventDataTypeUTF16String, StringData: &text}))
+}
+
+// finish forgets the request and counts its result.
+func (k *knock) finish(result string) {
+	k.timer.Stop()
+	delete(k.listener.knocks, k.listenerId.ID)
+	delete(k.connector.knocking, k.connectorId.ID)
+	k.connector.connectionPool.metrics.countJoin(k.connector.app(), result)
+	k.connector.logScoped(LevelDebug, k.address, "join request "+result, F("listener", k.listener.id))
+}
+
+// accept links the connector and listener with the ids of the request.
+func (k *knock) accept() {
+	k.finish(KnockAccepted)
+	sp, listener := k.connector, k.listener
+	listener.linkPeer(k.listenerId.ID, sp)
+	listener.sendToClient(NewNetworkEvent(NetEventTypeNewConnection, k.listenerId, &NetEventData{Type: NetEventDataTypeNull}))
+	sp.internalAddOutgoingPeer(listener, k.connectorId)
+	sp.joined.Store(k.address)
+	if sp.taps().enabled() {
+		sp.publish(TapEvent{Kind: TapLink, Address: k.address, OtherPeer: listener.id, ConnectionId: &k.connectorId.ID}, nil)
+	}
+}
+
+// refuse tells the connector why it wasn't let in.
+func (k *knock) refuse(reason string) {
+	sp := k.connector
+	if sp.taps().enabled() {
+		sp.publish(TapEvent{Kind: TapLinkFailed, Address: k.address, ConnectionId: &k.connectorId.ID, Reason: TapReasonKnock}, nil)
+	}
+	sp.refuseAccess(k.address, reason)
+	sp.sendToClient(NewNetworkEvent(NetEventTypeConnectionFailed, k.connectorId, &NetEventData{Type: NetEventDataTypeNull}))
+}
+
+// cancel withdraws the request of a connector that gave up or left.
+func (k *knock) cancel() {
+	k.finish(KnockCancelled)
+	k.listener.notifyJoin(k.listenerId, joinNotice{Cancelled: KnockCancelled})
+}
+
+// answerKnock handles the NewConnection or ConnectionFailed event of a
+// listener for a pending join request, it returns false if there is none.
+func (sp *SignalingPeer) answerKnock(id *ConnectionId, accept bool) bool {
+	k := sp.knocks[id.ID]
+	if k == nil {
+		return false
+	}
+	if accept {
+		k.accept()
+	} else {
+		k.finish(KnockRejected)
+		k.refuse("join request rejected")
+	}
+	return true
+}
+
+// dropKnocks refuses the requests to a listener that stopped listening.
+func (sp *SignalingPeer) dropKnocks() {
+	for _, k := range sp.knocks {
+		k.finish(KnockCancelled)
+		k.refuse("listener left")
+	}
+}
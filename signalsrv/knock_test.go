@@ -0,0 +1,131 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func expectJoinNotice(t *testing.T, c *testClient) (int16, joinNotice) {
+	t.Helper()
+	evt := c.expect(t, NetEventTypeLog)
+	var notice joinNotice
+	if err := json.Unmarshal([]byte(*evt.GetInfo().StringData), &notice); err != nil {
+		t.Fatal(err)
+	}
+	return evt.ConnectionId.ID, notice
+}
+
+func newKnockRoom(t *testing.T, timeout time.Duration) (*WebsocketNetworkServer, *testClient, *testClient, func()) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", KnockToJoin: true, KnockTimeout: timeout})
+	listener := dialTestClient(t, url)
+	listener.send(t, NetEventTypeServerInitialized, -1, "desk")
+	listener.expect(t, NetEventTypeServerInitialized)
+	c := dialTestClient(t, url)
+	return wns, listener, c, func() {
+		listener.conn.Close()
+		c.conn.Close()
+		closeServer()
+	}
+}
+
+func TestKnockAccept(t *testing.T) {
+	wns, listener, c, closeRoom := newKnockRoom(t, 0)
+	defer closeRoom()
+
+	c.send(t, NetEventTypeNewConnection, 3, "desk?meta=order+42")
+	id, notice := expectJoinNotice(t, listener)
+	if notice.Request == nil || notice.Request.Address != "desk" || notice.Request.Meta != "order 42" {
+		t.Fatalf("expected a join request got: %+v", notice)
+	}
+	c.expectNone(t, 50*time.Millisecond)
+
+	listener.send(t, NetEventTypeNewConnection, id, "")
+	if want, got := id, listener.expect(t, NetEventTypeNewConnection).ConnectionId.ID; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := int16(3), c.expect(t, NetEventTypeNewConnection).ConnectionId.ID; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	msg := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(3), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte("hi")})
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, msg.ToByteArray()); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := id, listener.expect(t, NetEventTypeReliableMessageReceived).ConnectionId.ID; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+
+	if want := `awsignal_join_requests_total{app="Test",result="accepted"} 1`; !strings.Contains(metricsText(wns), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+}
+
+func TestKnockReject(t *testing.T) {
+	_, listener, c, closeRoom := newKnockRoom(t, 0)
+	defer closeRoom()
+
+	c.send(t, NetEventTypeNewConnection, 1, "desk")
+	id, _ := expectJoinNotice(t, listener)
+	listener.send(t, NetEventTypeConnectionFailed, id, "")
+	if warning := *c.expect(t, NetEventTypeWarning).GetInfo().StringData; !strings.Contains(warning, "rejected") {
+		t.Errorf("expected a reason got: %s", warning)
+	}
+	c.expect(t, NetEventTypeConnectionFailed)
+	listener.expectNone(t, 50*time.Millisecond)
+
+	// the id of an answered request is spent
+	listener.send(t, NetEventTypeNewConnection, id, "")
+	listener.expect(t, NetEventTypeConnectionFailed)
+}
+
+func TestKnockTimeout(t *testing.T) {
+	wns, listener, c, closeRoom := newKnockRoom(t, 50*time.Millisecond)
+	defer closeRoom()
+
+	c.send(t, NetEventTypeNewConnection, 1, "desk")
+	id, _ := expectJoinNotice(t, listener)
+	c.expect(t, NetEventTypeWarning)
+	c.expect(t, NetEventTypeConnectionFailed)
+	cancelled, notice := expectJoinNotice(t, listener)
+	if cancelled != id || notice.Cancelled != KnockTimeout {
+		t.Errorf("expected request %d to time out got: %d %+v", id, cancelled, notice)
+	}
+	if want := `awsignal_join_requests_total{app="Test",result="timeout"} 1`; !strings.Contains(metricsText(wns), want) {
+		t.Errorf("expected metrics to contain %q", want)
+	}
+}
+
+func TestKnockCancel(t *testing.T) {
+	_, listener, c, closeRoom := newKnockRoom(t, 0)
+	defer closeRoom()
+
+	c.send(t, NetEventTypeNewConnection, 1, "desk")
+	id, _ := expectJoinNotice(t, listener)
+	c.send(t, NetEventTypeDisconnected, 1, "")
+	if cancelled, notice := expectJoinNotice(t, listener); cancelled != id || notice.Cancelled != KnockCancelled {
+		t.Errorf("expected request %d to be cancelled got: %d %+v", id, cancelled, notice)
+	}
+
+	c.send(t, NetEventTypeNewConnection, 2, "desk")
+	id, _ = expectJoinNotice(t, listener)
+	c.conn.Close()
+	if cancelled, notice := expectJoinNotice(t, listener); cancelled != id || notice.Cancelled != KnockCancelled {
+		t.Errorf("expected request %d to be cancelled got: %d %+v", id, cancelled, notice)
+	}
+}
+
+func TestKnockListenerLeaves(t *testing.T) {
+	_, listener, c, closeRoom := newKnockRoom(t, 0)
+	defer closeRoom()
+
+	c.send(t, NetEventTypeNewConnection, 1, "desk")
+	expectJoinNotice(t, listener)
+	listener.send(t, NetEventTypeServerClosed, -1, "")
+	if warning := *c.expect(t, NetEventTypeWarning).GetInfo().StringData; !strings.Contains(warning, "listener left") {
+		t.Errorf("expected a reason got: %s", warning)
+	}
+	c.expect(t, NetEventTypeConnectionFailed)
+}
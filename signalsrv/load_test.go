@@ -0,0 +1,159 @@
+package signalsrv
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	loadRooms    = flag.Int("load-rooms", 10, "number of shared rooms in BenchmarkLoad")
+	loadPeers    = flag.Int("load-peers", 5, "number of peers per room in BenchmarkLoad")
+	loadInFlight = flag.Int("load-inflight", 64, "messages in flight across all peers in BenchmarkLoad")
+)
+
+// loadPeer is a client of the load scenario. It sends reliable messages that
+// carry their send time and records the latency of the messages it receives.
+type loadPeer struct {
+	conn      *websocket.Conn
+	ids       []int16
+	joined    chan struct{}
+	latencies []time.Duration
+}
+
+func runLoadReader(p *loadPeer, members int, inFlight chan struct{}, received *sync.WaitGroup) {
+	for {
+		_, msg, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		evt, err := FromByteArray(msg)
+		if err != nil {
+			return
+		}
+		switch evt.Type {
+		case NetEventTypeNewConnection:
+			p.ids = append(p.ids, evt.ConnectionId.ID)
+			if len(p.ids) == members-1 {
+				close(p.joined)
+			}
+		case NetEventTypeReliableMessageReceived:
+			sent := int64(binary.LittleEndian.Uint64(evt.Data.ObjectData))
+			p.latencies = append(p.latencies, time.Duration(time.Now().UnixNano()-sent))
+			<-inFlight
+			received.Done()
+		}
+	}
+}
+
+func benchmarkLoad(b *testing.B, config *ServerConfig) {
+	quiet := *config
+	quiet.Logger = NewTextLogger(ioutil.Discard)
+	_, url, closeServer := newTestServer(b, &quiet, &AppConfig{Path: "/", AppName: "Load", AddressSharing: true})
+	defer closeServer()
+
+	var received sync.WaitGroup
+	inFlight := make(chan struct{}, *loadInFlight)
+	var peers []*loadPeer
+	for r := 0; r < *loadRooms; r++ {
+		room := fmt.Sprintf("room-%d", r)
+		for m := 0; m < *loadPeers; m++ {
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			p := &loadPeer{conn: conn, joined: make(chan struct{})}
+			if *loadPeers == 1 {
+				close(p.joined)
+			}
+			go runLoadReader(p, *loadPeers, inFlight, &received)
+			evt := NewNetworkEvent(NetEventTypeServerInitialized, INVALIDConnectionId,
+				&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &room})
+			if err := conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+				b.Fatal(err)
+			}
+			peers = append(peers, p)
+		}
+	}
+	for _, p := range peers {
+		select {
+		case <-p.joined:
+		case <-time.After(10 * time.Second):
+			b.Fatal("peers did not join their rooms")
+		}
+	}
+	if *loadPeers < 2 {
+		b.Skip("rooms need at least two peers")
+	}
+
+	received.Add(b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	var senders sync.WaitGroup
+	for i, p := range peers {
+		// peer i sends the messages i, i+len(peers), ...
+		count := b.N / len(peers)
+		if i < b.N%len(peers) {
+			count++
+		}
+		senders.Add(1)
+		go func(p *loadPeer, count int) {
+			defer senders.Done()
+			payload := make([]byte, 8)
+			for j := 0; j < count; j++ {
+				inFlight <- struct{}{}
+				binary.LittleEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+				evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(p.ids[j%len(p.ids)]),
+					&NetEventData{Type: NetEventDataTypeByteArray, ObjectData: payload})
+				if err := p.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+					// the unsent messages will never arrive
+					b.Error(err)
+					<-inFlight
+					received.Add(-(count - j))
+					return
+				}
+			}
+		}(p, count)
+	}
+	senders.Wait()
+	received.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	var latencies []time.Duration
+	for _, p := range peers {
+		latencies = append(latencies, p.latencies...)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))].Microseconds())
+	}
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "msgs/s")
+	b.ReportMetric(percentile(0.5), "p50-us")
+	b.ReportMetric(percentile(0.99), "p99-us")
+	b.ReportMetric(percentile(1), "max-us")
+}
+
+// BenchmarkLoad routes messages between the peers of -load-rooms shared rooms
+// with -load-peers peers each over real websocket connections. Run it with
+// -benchmem and -cpuprofile/-memprofile to compare releases.
+func BenchmarkLoad(b *testing.B) {
+	for _, mode := range []string{"default", "low-memory", "netpoll"} {
+		config := testModes[mode]
+		b.Run(mode, func(b *testing.B) {
+			benchmarkLoad(b, config)
+		})
+	}
+}
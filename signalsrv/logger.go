@@ -0,0 +1,311 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type Level int32
+
+// The zero Level is LevelInfo, so an unset level is quiet by default.
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, errors.Errorf("unknown log level %q", s)
+	}
+}
+
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger writes one structured record. Whether a record is written at all is
+// decided by the Verbosity of the server before Log is called.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+type streamLogger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+// NewTextLogger writes records as "time level msg key=value ...".
+func NewTextLogger(w io.Writer) Logger {
+	return &streamLogger{w: w}
+}
+
+// NewJSONLogger writes one JSON object per record.
+func NewJSONLogger(w io.Writer) Logger {
+	return &streamLogger{w: w, json: true}
+}
+
+func (l *streamLogger) Log(level Level, msg string, fields ...Field) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var sb strings.Builder
+	if l.json {
+		record := make(map[string]interface{}, len(fields)+3)
+		for _, f := range fields {
+			record[f.Key] = jsonValue(f.Value)
+		}
+		record["time"] = now
+		record["level"] = level.String()
+		record["msg"] = msg
+		b, err := json.Marshal(record)
+		if err != nil {
+			b, _ = json.Marshal(map[string]string{"time": now, "level": level.String(), "msg": msg, "error": err.Error()})
+		}
+		sb.Write(b)
+	} else {
+		sb.WriteString(now)
+		sb.WriteByte(' ')
+		sb.WriteString(strings.ToUpper(level.String()))
+		sb.WriteByte(' ')
+		sb.WriteString(msg)
+		for _, f := range fields {
+			sb.WriteByte(' ')
+			sb.WriteString(f.Key)
+			sb.WriteByte('=')
+			sb.WriteString(textValue(f.Value))
+		}
+	}
+	sb.WriteByte('\n')
+
+	l.mu.Lock()
+	io.WriteString(l.w, sb.String())
+	l.mu.Unlock()
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Verbosity decides which records are written. The level can be lowered for
+// single apps or addresses while the server is running, e.g. to debug one
+// room without flooding the log with every other room.
+type Verbosity struct {
+	mu        sync.RWMutex
+	level     Level
+	apps      map[string]Level
+	addresses map[string]Level
+	payloads  bool
+}
+
+func NewVerbosity(level Level) *Verbosity {
+	return &Verbosity{
+		level:     level,
+		apps:      make(map[string]Level),
+		addresses: make(map[string]Level),
+	}
+}
+
+func (v *Verbosity) SetLevel(level Level) {
+	v.mu.Lock()
+	v.level = level
+	v.mu.Unlock()
+}
+
+func (v *Verbosity) SetAppLevel(app string, level Level) {
+	v.mu.Lock()
+	v.apps[app] = level
+	v.mu.Unlock()
+}
+
+func (v *Verbosity) ClearAppLevel(app string) {
+	v.mu.Lock()
+	delete(v.apps, app)
+	v.mu.Unlock()
+}
+
+func (v *Verbosity) SetAddressLevel(address string, level Level) {
+	v.mu.Lock()
+	v.addresses[address] = level
+	v.mu.Unlock()
+}
+
+func (v *Verbosity) ClearAddressLevel(address string) {
+	v.mu.Lock()
+	delete(v.addresses, address)
+	v.mu.Unlock()
+}
+
+// SetPayloads controls whether message payloads are logged with events.
+func (v *Verbosity) SetPayloads(enabled bool) {
+	v.mu.Lock()
+	v.payloads = enabled
+	v.mu.Unlock()
+}
+
+func (v *Verbosity) Payloads() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.payloads
+}
+
+// Enabled reports whether a record of the given level is written for the app
+// and address, the most verbose matching setting wins.
+func (v *Verbosity) Enabled(level Level, app, address string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	min := v.level
+	if l, ok := v.apps[app]; ok && l < min {
+		min = l
+	}
+	if address != "" {
+		if l, ok := v.addresses[address]; ok && l < min {
+			min = l
+		}
+	}
+	return level >= min
+}
+
+type verbositySnapshot struct {
+	Level     string            `json:"level"`
+	Apps      map[string]string `json:"apps"`
+	Addresses map[string]string `json:"addresses"`
+	Payloads  bool              `json:"payloads"`
+}
+
+func (v *Verbosity) snapshot() verbositySnapshot {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	s := verbositySnapshot{
+		Level:     v.level.String(),
+		Apps:      make(map[string]string, len(v.apps)),
+		Addresses: make(map[string]string, len(v.addresses)),
+		Payloads:  v.payloads,
+	}
+	for app, l := range v.apps {
+		s.Apps[app] = l.String()
+	}
+	for address, l := range v.addresses {
+		s.Addresses[address] = l.String()
+	}
+	return s
+}
+
+// ServeHTTP shows the verbosity on GET. POST changes it with the form values
+// level, app or address (to scope the level, level=reset removes the
+// override) and payloads.
+func (v *Verbosity) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := v.update(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v.snapshot())
+}
+
+func (v *Verbosity) update(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	if s := r.Form.Get("payloads"); s != "" {
+		enabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.Errorf("invalid payloads value %q", s)
+		}
+		v.SetPayloads(enabled)
+	}
+	s := r.Form.Get("level")
+	if s == "" {
+		return nil
+	}
+	app, address := r.Form.Get("app"), r.Form.Get("address")
+	if s == "reset" {
+		if app != "" {
+			v.ClearAppLevel(app)
+		}
+		if address != "" {
+			v.ClearAddressLevel(address)
+		}
+		return nil
+	}
+	level, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	switch {
+	case app != "":
+		v.SetAppLevel(app, level)
+	case address != "":
+		v.SetAddressLevel(address, level)
+	default:
+		v.SetLevel(level)
+	}
+	return nil
+}
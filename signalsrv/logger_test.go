@@ -0,0 +1,104 @@
+package signalsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	NewTextLogger(&buf).Log(LevelWarn, "read failed", F("peer", PeerId(7)), F("error", errors.New("i/o timeout")), F("address", "room"))
+
+	line := buf.String()
+	if want := ` WARN read failed peer=7 error="i/o timeout" address=room` + "\n"; !strings.HasSuffix(line, want) {
+		t.Errorf("expected line ending with %q got: %q", want, line)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	NewJSONLogger(&buf).Log(LevelInfo, "peer connected", F("app", "Test"), F("peer", PeerId(7)))
+
+	record := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{"level": "info", "msg": "peer connected", "app": "Test", "peer": float64(7)} {
+		if got := record[key]; got != want {
+			t.Errorf("expected %s %v got: %v", key, want, got)
+		}
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	v := NewVerbosity(LevelInfo)
+	if v.Enabled(LevelDebug, "Test", "room") {
+		t.Errorf("expected debug to be disabled by default")
+	}
+	if !v.Enabled(LevelInfo, "Test", "room") {
+		t.Errorf("expected info to be enabled by default")
+	}
+
+	v.SetAddressLevel("room", LevelDebug)
+	if !v.Enabled(LevelDebug, "Test", "room") {
+		t.Errorf("expected debug for address room")
+	}
+	if v.Enabled(LevelDebug, "Test", "other") {
+		t.Errorf("expected no debug for address other")
+	}
+
+	v.SetAppLevel("Other", LevelDebug)
+	if !v.Enabled(LevelDebug, "Other", "") {
+		t.Errorf("expected debug for app Other")
+	}
+	v.ClearAppLevel("Other")
+	if v.Enabled(LevelDebug, "Other", "") {
+		t.Errorf("expected no debug for app Other after reset")
+	}
+}
+
+func TestVerbosityHandler(t *testing.T) {
+	v := NewVerbosity(LevelInfo)
+	post := func(values url.Values) int {
+		req := httptest.NewRequest("POST", "/log", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		v.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if want, got := 200, post(url.Values{"level": {"debug"}, "app": {"Test"}, "payloads": {"true"}}); want != got {
+		t.Fatalf("expected status %d got: %d", want, got)
+	}
+	if !v.Enabled(LevelDebug, "Test", "") || !v.Payloads() {
+		t.Errorf("expected debug with payloads for app Test")
+	}
+	if want, got := 400, post(url.Values{"level": {"loud"}}); want != got {
+		t.Errorf("expected status %d got: %d", want, got)
+	}
+}
+
+func TestPayloadsHidden(t *testing.T) {
+	var buf bytes.Buffer
+	verbosity := NewVerbosity(LevelDebug)
+	wns := NewWebsocketNetworkServer(&ServerConfig{Logger: NewTextLogger(&buf), Verbosity: verbosity})
+	pool := NewPeerPool(wns, &AppConfig{AppName: "Test"})
+	sp := newTestPeer(pool, "10.0.0.1:5000", 1)
+	evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(1),
+		&NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte{'s', 0, 'd', 0, 'p', 0}})
+
+	sp.logEvent(DirectionIn, evt, 14)
+	if strings.Contains(buf.String(), "sdp") {
+		t.Errorf("expected payload to be hidden got: %s", buf.String())
+	}
+	verbosity.SetPayloads(true)
+	sp.logEvent(DirectionIn, evt, 14)
+	if !strings.Contains(buf.String(), "sdp") {
+		t.Errorf("expected payload to be logged got: %s", buf.String())
+	}
+}
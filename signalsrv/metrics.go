@@ -0,0 +1,369 @@
+package signalsrv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+const (
+	DropNotConnected      = "not_connected"
+	DropQueueFull         = "queue_full"
+	DropDiscardedOnClose  = "discarded_on_close"
+	DropUnknownConnection = "unknown_connection"
+)
+
+// Metrics collects the counters of a WebsocketNetworkServer and renders them
+// in the Prometheus text exposition format. Gauges are read from the pools at
+// scrape time.
+type Metrics struct {
+	server      *WebsocketNetworkServer
+	events      *counterVec
+	bytes       *counterVec
+	drops       *counterVec
+	disconnects *counterVec
+	queueWait   *histogramVec
+	rtt         *histogramVec
+	missedPongs *counterVec
+	rejects     *counterVec
+	denied      *counterVec
+	limited     *counterVec
+	banned      *counterVec
+	joins       *counterVec
+}
+
+func newMetrics(server *WebsocketNetworkServer) *Metrics {
+	return &Metrics{
+		server:      server,
+		events:      newCounterVec("awsignal_events_total", "Signaling events by app, event type and direction.", "app", "type", "direction"),
+		bytes:       newCounterVec("awsignal_event_bytes_total", "Encoded size of signaling events by app, event type and direction.", "app", "type", "direction"),
+		drops:       newCounterVec("awsignal_dropped_events_total", "Outgoing events that were not delivered.", "app", "reason"),
+		disconnects: newCounterVec("awsignal_disconnects_total", "Closed peers by disconnect reason.", "app", "reason"),
+		queueWait: newHistogramVec("awsignal_send_queue_wait_seconds", "Time outgoing events spent in the send queue of a peer.",
+			[]float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}, "app"),
+		rtt: newHistogramVec("awsignal_ping_rtt_seconds", "Round trip time of keepalive pings.",
+			[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5}, "app"),
+		missedPongs: newCounterVec("awsignal_missed_pongs_total", "Keepalive pings that were not answered before the next ping.", "app"),
+		rejects:     newCounterVec("awsignal_rejected_upgrades_total", "Upgrade requests that were refused by reason.", "app", "reason"),
+		limited:     newCounterVec("awsignal_rate_limited_total", "Inbound events over the rate limits of their peer by action.", "app", "action"),
+		banned:      newCounterVec("awsignal_banned_total", "Upgrades, listens and connects refused by a ban by kind.", "app", "kind"),
+		joins:       newCounterVec("awsignal_join_requests_total", "Join requests of apps with knock to join by result.", "app", "result"),
+		denied:      newCounterVec("awsignal_denied_total", "Listen and connect requests the claims of the peer didn't allow.", "app", "action"),
+	}
+}
+
+func eventTypeLabel(t int) string {
+	if name, ok := NetEventTypeITS[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+func (m *Metrics) countEvent(app string, evt *NetworkEvent, direction string, size int) {
+	if m == nil {
+		return
+	}
+	typ := eventTypeLabel(evt.Type)
+	m.events.add(1, app, typ, direction)
+	m.bytes.add(uint64(size), app, typ, direction)
+}
+
+func (m *Metrics) countDrop(app string, reason string, n int) {
+	if m == nil {
+		return
+	}
+	m.drops.add(uint64(n), app, reason)
+}
+
+func (m *Metrics) countDisconnect(app string, reason DisconnectReason) {
+	if m == nil {
+		return
+	}
+	m.disconnects.add(1, app, string(reason))
+}
+
+func (m *Metrics) countReject(app string, reason string) {
+	if m == nil {
+		return
+	}
+	m.rejects.add(1, app, reason)
+}
+
+func (m *Metrics) countDenied(app string, action string) {
+	if m == nil {
+		return
+	}
+	m.denied.add(1, app, action)
+}
+
+func (m *Metrics) countLimited(app string, action LimitAction) {
+	if m == nil {
+		return
+	}
+	m.limited.add(1, app, string(action))
+}
+
+func (m *Metrics) countBanned(app string, kind BanKind) {
+	if m == nil {
+		return
+	}
+	m.banned.add(1, app, string(kind))
+}
+
+func (m *Metrics) countJoin(app, result string) {
+	if m == nil {
+		return
+	}
+	m.joins.add(1, app, result)
+}
+
+func (m *Metrics) observeQueueWait(app string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.queueWait.observe(d.Seconds(), app)
+}
+
+func (m *Metrics) observeRTT(app string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.rtt.observe(d.Seconds(), app)
+}
+
+func (m *Metrics) countMissedPong(app string) {
+	if m == nil {
+		return
+	}
+	m.missedPongs.add(1, app)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var sb strings.Builder
+	m.writeGauges(&sb)
+	m.events.write(&sb)
+	m.bytes.write(&sb)
+	m.drops.write(&sb)
+	m.disconnects.write(&sb)
+	m.queueWait.write(&sb)
+	m.rtt.write(&sb)
+	m.missedPongs.write(&sb)
+	m.rejects.write(&sb)
+	m.denied.write(&sb)
+	m.limited.write(&sb)
+	m.banned.write(&sb)
+	m.joins.write(&sb)
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (m *Metrics) writeGauges(sb *strings.Builder) {
+	peers := newGaugeFamily("awsignal_peers", "Connected peers by app.")
+	addresses := newGaugeFamily("awsignal_addresses", "Addresses with at least one listening peer by app.")
+	shared := newGaugeFamily("awsignal_address_peers", "Peers listening on a shared address.")
+	for _, pp := range m.server.pools() {
+		app := pp.appConfig.AppName
+		pp.mu.Lock()
+		peers.set(float64(pp.count()), "app", app)
+		addresses.set(float64(len(pp.servers)), "app", app)
+		if pp.hasAddressSharing() {
+			for address, listeners := range pp.servers {
+				shared.set(float64(len(listeners)), "app", app, "address", address)
+			}
+		}
+		pp.mu.Unlock()
+	}
+	peers.write(sb)
+	addresses.write(sb)
+	shared.write(sb)
+}
+
+func writeHeader(sb *strings.Builder, name, help, typ string) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {name="value",...} from alternating names and values.
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func labelPairs(names, values []string) []string {
+	pairs := make([]string, 0, len(names)*2)
+	for i, name := range names {
+		pairs = append(pairs, name, values[i])
+	}
+	return pairs
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type gaugeFamily struct {
+	name, help string
+	lines      []string
+}
+
+func newGaugeFamily(name, help string) *gaugeFamily {
+	return &gaugeFamily{name: name, help: help}
+}
+
+func (g *gaugeFamily) set(v float64, pairs ...string) {
+	g.lines = append(g.lines, g.name+formatLabels(pairs...)+" "+formatFloat(v))
+}
+
+func (g *gaugeFamily) write(sb *strings.Builder) {
+	writeHeader(sb, g.name, g.help, "gauge")
+	sort.Strings(g.lines)
+	for _, line := range g.lines {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.RWMutex
+	values     map[string]*uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*uint64)}
+}
+
+func (c *counterVec) add(v uint64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.RLock()
+	p, ok := c.values[key]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if p, ok = c.values[key]; !ok {
+			p = new(uint64)
+			c.values[key] = p
+		}
+		c.mu.Unlock()
+	}
+	atomic.AddUint64(p, v)
+}
+
+func (c *counterVec) get(values ...string) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if p, ok := c.values[strings.Join(values, "\xff")]; ok {
+		return atomic.LoadUint64(p)
+	}
+	return 0
+}
+
+func (c *counterVec) write(sb *strings.Builder) {
+	writeHeader(sb, c.name, c.help, "counter")
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := formatLabels(labelPairs(c.labels, strings.Split(key, "\xff"))...)
+		fmt.Fprintf(sb, "%s%s %d\n", c.name, labels, atomic.LoadUint64(c.values[key]))
+	}
+	c.mu.RUnlock()
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.RWMutex
+	values     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.RLock()
+	hist, ok := h.values[key]
+	h.mu.RUnlock()
+	if !ok {
+		h.mu.Lock()
+		if hist, ok = h.values[key]; !ok {
+			hist = &histogram{counts: make([]uint64, len(h.buckets))}
+			h.values[key] = hist
+		}
+		h.mu.Unlock()
+	}
+
+	hist.mu.Lock()
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+	hist.mu.Unlock()
+}
+
+func (h *histogramVec) write(sb *strings.Builder) {
+	writeHeader(sb, h.name, h.help, "histogram")
+	h.mu.RLock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		pairs := labelPairs(h.labels, strings.Split(key, "\xff"))
+		hist := h.values[key]
+		hist.mu.Lock()
+		for i, le := range h.buckets {
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(append(pairs, "le", formatFloat(le))...), hist.counts[i])
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", h.name, formatLabels(append(pairs, "le", "+Inf")...), hist.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", h.name, formatLabels(pairs...), formatFloat(hist.sum))
+		fmt.Fprintf(sb, "%s_count%s %d\n", h.name, formatLabels(pairs...), hist.count)
+		hist.mu.Unlock()
+	}
+	h.mu.RUnlock()
+}
@@ -0,0 +1,70 @@
+package signalsrv
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMetrics(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, testModes["default"], &AppConfig{Path: "/", AppName: "Test", AddressSharing: true})
+	defer closeServer()
+
+	a := dialTestClient(t, url)
+	defer a.conn.Close()
+	a.send(t, NetEventTypeServerInitialized, -1, "room")
+	a.expect(t, NetEventTypeServerInitialized)
+	b := dialTestClient(t, url)
+	b.send(t, NetEventTypeServerInitialized, -1, "room")
+	b.expect(t, NetEventTypeServerInitialized)
+	b.expect(t, NetEventTypeNewConnection)
+	a.expect(t, NetEventTypeNewConnection)
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		wns.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	body := scrape()
+	for _, want := range []string{
+		`awsignal_peers{app="Test"} 2`,
+		`awsignal_addresses{app="Test"} 1`,
+		`awsignal_address_peers{app="Test",address="room"} 2`,
+		`awsignal_events_total{app="Test",type="ServerInitialized",direction="in"} 2`,
+		`awsignal_events_total{app="Test",type="NewConnection",direction="out"} 2`,
+		`awsignal_event_bytes_total{app="Test",type="ServerInitialized",direction="in"} 32`,
+		`awsignal_send_queue_wait_seconds_count{app="Test"} 4`,
+		`# TYPE awsignal_send_queue_wait_seconds histogram`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q got:\n%s", want, body)
+		}
+	}
+
+	b.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	b.conn.Close()
+	a.expect(t, NetEventTypeDisconnected)
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(scrape(), `awsignal_peers{app="Test"} 1`) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	body = scrape()
+	for _, want := range []string{
+		`awsignal_peers{app="Test"} 1`,
+		`awsignal_address_peers{app="Test",address="room"} 1`,
+		`awsignal_disconnects_total{app="Test",reason="client_closed"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected metrics to contain %q got:\n%s", want, body)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	if want, got := `{app="a\"b",address="c\\d\ne"}`, formatLabels("app", `a"b`, "address", "c\\d\ne"); want != got {
+		t.Errorf("expected labels %s got: %s", want, got)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"log"
 	"reflect"
 	"unicode/utf16"
 
@@ -139,10 +138,7 @@ func (ne *NetworkEvent) String() (output string) {
 	if ne.Data.Type == NetEventDataTypeUTF16String && ne.Data.StringData != nil {
 		data = *ne.Data.StringData
 	} else if ne.Data.Type == NetEventDataTypeByteArray {
-		d, err := toUint16Array(ne.Data.ObjectData)
-		if err != nil {
-			log.Println("parse data error: ", err)
-		} else {
+		if d, err := toUint16Array(ne.Data.ObjectData); err == nil {
 			data = string(utf16.Decode(d))
 		}
 	}
@@ -158,12 +154,18 @@ type baseNetworkEvent struct {
 	Data         interface{}   `json:"data"`
 }
 
+// ParseFromString parses the JSON form of a NetworkEvent, it returns nil if
+// str is invalid. ParseNetworkEvent tells why.
 func ParseFromString(str string) *NetworkEvent {
+	evt, _ := ParseNetworkEvent(str)
+	return evt
+}
+
+// ParseNetworkEvent parses the JSON form of a NetworkEvent.
+func ParseNetworkEvent(str string) (*NetworkEvent, error) {
 	evt := baseNetworkEvent{}
-	err := json.Unmarshal([]byte(str), &evt)
-	if err != nil {
-		log.Printf("ParseFromString error. str: %s, err: %s", str, err.Error())
-		return nil
+	if err := json.Unmarshal([]byte(str), &evt); err != nil {
+		return nil, errors.Wrap(err, "parse event")
 	}
 
 	var cid *ConnectionId
@@ -183,14 +185,17 @@ func ParseFromString(str string) *NetworkEvent {
 	} else if reflect.TypeOf(evt.Data).String() == "[]interface {}" {
 		data.Type = NetEventDataTypeByteArray
 		for _, v := range evt.Data.([]interface{}) {
-			data.ObjectData = append(data.ObjectData, uint8(v.(float64)))
+			b, ok := v.(float64)
+			if !ok {
+				return nil, errors.Errorf("invalid byte %v", v)
+			}
+			data.ObjectData = append(data.ObjectData, uint8(b))
 		}
 	} else {
-		log.Println("data can't be parsed")
-		return nil
+		return nil, errors.Errorf("data of type %T can't be parsed", evt.Data)
 	}
 
-	return NewNetworkEvent(evt.Type, cid, data)
+	return NewNetworkEvent(evt.Type, cid, data), nil
 }
 
 // 首先数据是小端字节序
@@ -200,26 +205,33 @@ func ParseFromString(str string) *NetworkEvent {
 // arr[8:data_length]为数据(data, uint16)
 // arr 转换为 event_type = 3, data_type = 2, connection_id = -1, data_length = 3, data = "123"
 func FromByteArray(arr []byte) (*NetworkEvent, error) {
+	if len(arr) < 4 {
+		return nil, errors.Errorf("message too short: %d bytes", len(arr))
+	}
 	typ := int(arr[0])
 	dataType := arr[1]
 	var id int16
 	err := binary.Read(bytes.NewReader(arr[2:4]), binary.LittleEndian, &id)
 	if err != nil {
-		log.Println("parse id error: ", err)
 		return nil, err
 	}
 
 	data := new(NetEventData)
 	switch NetEventDataType(dataType) {
 	case NetEventDataTypeByteArray:
-		length := binary.LittleEndian.Uint32(arr[4:8])
+		length, err := dataLength(arr, 1)
+		if err != nil {
+			return nil, err
+		}
 		data.Type = NetEventDataTypeByteArray
 		data.ObjectData = arr[8 : 8+length]
 	case NetEventDataTypeUTF16String:
-		length := binary.LittleEndian.Uint32(arr[4:8])
+		length, err := dataLength(arr, 2)
+		if err != nil {
+			return nil, err
+		}
 		d, err := toUint16Array(arr[8 : 8+length*2])
 		if err != nil {
-			log.Println("parse data error: ", err)
 			return nil, err
 		}
 		data.Type = NetEventDataTypeUTF16String
@@ -228,13 +240,25 @@ func FromByteArray(arr []byte) (*NetworkEvent, error) {
 	case NetEventDataTypeNull:
 		data.Type = NetEventDataTypeNull
 	default:
-		log.Println("Message has an invalid data type flag: ", dataType)
 		return nil, errors.New(fmt.Sprintf("Message has an invalid data type flag: %d", dataType))
 	}
 
 	return NewNetworkEvent(typ, NewConnectionId(id), data), nil
 }
 
+// dataLength reads the length field and checks that the message holds that
+// many elements of the given size.
+func dataLength(arr []byte, size uint64) (uint64, error) {
+	if len(arr) < 8 {
+		return 0, errors.Errorf("message too short: %d bytes", len(arr))
+	}
+	length := uint64(binary.LittleEndian.Uint32(arr[4:8]))
+	if 8+length*size > uint64(len(arr)) {
+		return 0, errors.Errorf("data length %d exceeds message of %d bytes", length, len(arr))
+	}
+	return length, nil
+}
+
 func toUint16Array(buf []byte) ([]uint16, error) {
 	if len(buf)%2 != 0 {
 		return nil, errors.New("trailing bytes")
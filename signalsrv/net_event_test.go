@@ -2,6 +2,8 @@ package signalsrv
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -78,6 +80,17 @@ func TestParseFromString(t *testing.T) {
 	}
 }
 
+func TestParseNetworkEvent(t *testing.T) {
+	for _, str := range []string{`{"type":`, `{"type":1,"data":{}}`, `{"type":1,"data":["a"]}`} {
+		if _, err := ParseNetworkEvent(str); err == nil {
+			t.Errorf("expected %s to fail", str)
+		}
+		if ne := ParseFromString(str); ne != nil {
+			t.Errorf("expected %s to parse to nil got: %v", str, ne)
+		}
+	}
+}
+
 func TestFromByteArray(t *testing.T) {
 	ne, _ := FromByteArray([]byte{3, 2, 255, 255, 3, 0, 0, 0, 49, 0, 50, 0, 51, 0})
 
@@ -98,6 +111,21 @@ func TestFromByteArray(t *testing.T) {
 	}
 }
 
+func TestFromByteArrayInvalid(t *testing.T) {
+	for _, arr := range [][]byte{
+		{},
+		{3, 2, 255},
+		{3, 2, 255, 255, 3, 0},
+		{3, 2, 255, 255, 3, 0, 0, 0, 49, 0, 50, 0},
+		{1, 1, 0, 0, 255, 255, 255, 255, 1},
+		{3, 9, 255, 255},
+	} {
+		if _, err := FromByteArray(arr); err == nil {
+			t.Errorf("expected error for %v", arr)
+		}
+	}
+}
+
 func TestToByteArray(t *testing.T) {
 	s := "123"
 	ne := NewNetworkEvent(
@@ -113,3 +141,80 @@ func TestToByteArray(t *testing.T) {
 		t.Errorf("expected to by array want: %v got: %v", want, got)
 	}
 }
+
+// benchmarkEvents are typical signaling payloads: an address, a short message
+// and an SDP offer sized byte array.
+func benchmarkEvents() map[string]*NetworkEvent {
+	addr := "conference-room-42"
+	sdp := []byte(strings.Repeat("a=candidate:1 1 udp 2122260223 192.168.1.10 54321 typ host\r\n", 40))
+	return map[string]*NetworkEvent{
+		"null":   NewNetworkEvent(NetEventTypeDisconnected, NewConnectionId(1), &NetEventData{Type: NetEventDataTypeNull}),
+		"string": NewNetworkEvent(NetEventTypeServerInitialized, INVALIDConnectionId, &NetEventData{Type: NetEventDataTypeUTF16String, StringData: &addr}),
+		"bytes":  NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(1), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: sdp}),
+	}
+}
+
+func BenchmarkFromByteArray(b *testing.B) {
+	for name, evt := range benchmarkEvents() {
+		arr := evt.ToByteArray()
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(arr)))
+			for i := 0; i < b.N; i++ {
+				if _, err := FromByteArray(arr); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkToByteArray(b *testing.B) {
+	for name, evt := range benchmarkEvents() {
+		evt := evt
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(evt.ToByteArray())))
+			for i := 0; i < b.N; i++ {
+				evt.ToByteArray()
+			}
+		})
+	}
+}
+
+func BenchmarkParseFromString(b *testing.B) {
+	sdp := make([]string, 2400)
+	for i := range sdp {
+		sdp[i] = fmt.Sprint(i % 256)
+	}
+	inputs := map[string]string{
+		"null":   `{"type":8,"connectionId":{"id":1}}`,
+		"string": `{"type":3,"connectionId":{"id":-1},"data":"conference-room-42"}`,
+		"bytes":  `{"type":2,"connectionId":{"id":1},"data":[` + strings.Join(sdp, ",") + `]}`,
+	}
+	for name, str := range inputs {
+		str := str
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(str)))
+			for i := 0; i < b.N; i++ {
+				if ParseFromString(str) == nil {
+					b.Fatal("ParseFromString failed")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkString measures the formatting done for every logged event.
+func BenchmarkString(b *testing.B) {
+	for name, evt := range benchmarkEvents() {
+		evt := evt
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = evt.String()
+			}
+		})
+	}
+}
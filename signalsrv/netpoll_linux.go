@@ -0,0 +1,148 @@
+package signalsrv
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+const netpollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// netpoll waits for readable sockets with one epoll instance. Sockets are
+// registered one-shot, a peer re-arms its socket after it has read everything.
+type netpoll struct {
+	log     func(Level, string, ...Field)
+	fd      int
+	wake    [2]int
+	mu      sync.Mutex
+	peers   map[int]*SignalingPeer
+	stopped int32
+}
+
+func newNetpoll(log func(Level, string, ...Field)) (*netpoll, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "epoll_create1")
+	}
+	np := &netpoll{
+		log:   log,
+		fd:    fd,
+		peers: make(map[int]*SignalingPeer),
+	}
+	// closing the epoll descriptor does not interrupt epoll_wait, close
+	// writes to this pipe instead.
+	if err := syscall.Pipe2(np.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(fd)
+		return nil, errors.Wrap(err, "pipe2")
+	}
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(np.wake[0])}
+	if err := syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, np.wake[0], ev); err != nil {
+		syscall.Close(fd)
+		syscall.Close(np.wake[0])
+		syscall.Close(np.wake[1])
+		return nil, errors.Wrap(err, "epoll_ctl add")
+	}
+	go np.wait()
+	return np, nil
+}
+
+func (np *netpoll) close() {
+	syscall.Write(np.wake[1], []byte{0})
+}
+
+func socketFd(conn *websocket.Conn) (int, error) {
+	sc, ok := conn.UnderlyingConn().(syscall.Conn)
+	if !ok {
+		return -1, errors.New("connection has no file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+func (np *netpoll) add(sp *SignalingPeer) error {
+	fd, err := socketFd(sp.socket)
+	if err != nil {
+		return err
+	}
+	sp.pollFd = fd
+	np.mu.Lock()
+	np.peers[fd] = sp
+	np.mu.Unlock()
+
+	ev := &syscall.EpollEvent{Events: netpollEvents, Fd: int32(fd), Pad: int32(sp.id)}
+	if err := syscall.EpollCtl(np.fd, syscall.EPOLL_CTL_ADD, fd, ev); err != nil {
+		np.mu.Lock()
+		delete(np.peers, fd)
+		np.mu.Unlock()
+		return errors.Wrap(err, "epoll_ctl add")
+	}
+	return nil
+}
+
+func (np *netpoll) rearm(sp *SignalingPeer) error {
+	ev := &syscall.EpollEvent{Events: netpollEvents, Fd: int32(sp.pollFd), Pad: int32(sp.id)}
+	return errors.Wrap(syscall.EpollCtl(np.fd, syscall.EPOLL_CTL_MOD, sp.pollFd, ev), "epoll_ctl mod")
+}
+
+// remove must be called before the socket is closed, a closed descriptor may
+// be reused by the next connection.
+func (np *netpoll) remove(sp *SignalingPeer) {
+	np.mu.Lock()
+	if np.peers[sp.pollFd] == sp {
+		delete(np.peers, sp.pollFd)
+	}
+	np.mu.Unlock()
+	syscall.EpollCtl(np.fd, syscall.EPOLL_CTL_DEL, sp.pollFd, nil)
+}
+
+func (np *netpoll) wait() {
+	defer func() {
+		atomic.StoreInt32(&np.stopped, 1)
+		syscall.Close(np.fd)
+		syscall.Close(np.wake[0])
+		syscall.Close(np.wake[1])
+	}()
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(np.fd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			np.log(LevelError, "netpoll stopped", F("error", err))
+			return
+		}
+		np.mu.Lock()
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == np.wake[0] {
+				np.mu.Unlock()
+				return
+			}
+			// remove takes mu, so a removed peer never gets a new pump. Pad
+			// holds the peer id, an event for a closed socket must not reach
+			// the peer that reused its descriptor.
+			if sp, ok := np.peers[fd]; ok && int32(sp.id) == events[i].Pad {
+				sp.startPump(sp.pollRead)
+			}
+		}
+		np.mu.Unlock()
+	}
+}
+
+// responsive reports whether the epoll loop is running and not stuck while
+// dispatching.
+func (np *netpoll) responsive(timeout time.Duration) bool {
+	return atomic.LoadInt32(&np.stopped) == 0 && tryLock(&np.mu, timeout)
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package signalsrv
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type netpoll struct{}
+
+func newNetpoll(log func(Level, string, ...Field)) (*netpoll, error) {
+	return nil, errors.New("netpoll is only supported on linux")
+}
+
+func (np *netpoll) add(sp *SignalingPeer) error {
+	return errors.New("netpoll is only supported on linux")
+}
+
+func (np *netpoll) rearm(sp *SignalingPeer) error {
+	return nil
+}
+
+func (np *netpoll) remove(sp *SignalingPeer) {}
+
+func (np *netpoll) close() {}
+
+func (np *netpoll) responsive(timeout time.Duration) bool {
+	return true
+}
@@ -0,0 +1,53 @@
+package signalsrv
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RejectOrigin is the reason counted for upgrades from origins that aren't
+// allowed.
+const RejectOrigin = "origin"
+
+// originAllowed checks the Origin header of an upgrade request against the
+// app's allowlist. Without an allowlist it keeps the gorilla default: a
+// missing Origin or one matching the request host.
+func (c *AppConfig) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return len(c.AllowedOrigins) == 0 || c.AllowMissingOrigin
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if matchOrigin(allowed, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches an origin against an allowlist entry. An entry is "*",
+// an exact origin like "https://app.example.com" or one whose host starts
+// with a wildcard label like "https://*.example.com", which matches any
+// subdomain but not example.com itself.
+func matchOrigin(allowed string, origin *url.URL) bool {
+	if allowed == "*" {
+		return true
+	}
+	i := strings.Index(allowed, "://")
+	if i < 0 || !strings.EqualFold(allowed[:i], origin.Scheme) {
+		return false
+	}
+	host := strings.ToLower(allowed[i+3:])
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(strings.ToLower(origin.Host), host[1:])
+	}
+	return host == strings.ToLower(origin.Host)
+}
@@ -0,0 +1,86 @@
+package signalsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	app := &AppConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.cdn.example.com"}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://eu.cdn.example.com", true},
+		{"https://a.b.cdn.example.com", true},
+		{"https://cdn.example.com", false},
+		{"https://evilcdn.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://signal.example.com/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if want, got := test.want, app.originAllowed(r); want != got {
+			t.Errorf("expected %v for %q got: %v", want, test.origin, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://signal.example.com/", nil)
+	app.AllowMissingOrigin = true
+	if !app.originAllowed(r) {
+		t.Error("expected a missing origin to be allowed")
+	}
+
+	// without an allowlist only the request host is allowed
+	def := &AppConfig{}
+	if !def.originAllowed(r) {
+		t.Error("expected a missing origin to be allowed by default")
+	}
+	r.Header.Set("Origin", "https://signal.example.com")
+	if !def.originAllowed(r) {
+		t.Error("expected the request host to be allowed by default")
+	}
+	r.Header.Set("Origin", "https://other.example.com")
+	if def.originAllowed(r) {
+		t.Error("expected other hosts to be rejected by default")
+	}
+}
+
+func TestOriginRejected(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", AllowedOrigins: []string{"https://*.example.com"}})
+	defer closeServer()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}})
+	if err == nil {
+		t.Fatal("expected the upgrade to be rejected")
+	}
+	if want, got := http.StatusForbidden, resp.StatusCode; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Error("expected a missing origin to be rejected")
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	rec := httptest.NewRecorder()
+	wns.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `awsignal_rejected_upgrades_total{app="Test",reason="origin"} 2`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("expected metrics to contain %q got:\n%s", want, rec.Body.String())
+	}
+}
@@ -1,26 +1,48 @@
 package signalsrv
 
 import (
-	"log"
+	"bufio"
+	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
+// PeerPool holds the peers of one app. mu guards the pool and the routing
+// state of all its peers, incoming events are handled with mu locked.
 type PeerPool struct {
+	mu               sync.Mutex
 	connections      []*SignalingPeer
+	slots            map[*SignalingPeer]int
+	ids              map[PeerId]*SignalingPeer
 	servers          map[string][]*SignalingPeer
+	serverSlots      map[*SignalingPeer]int
+	locks            map[string]*addressLock
+	invites          map[string]*Invite
 	addressSharing   bool
 	maxAddressLength int
 	appConfig        *AppConfig
+	server           *WebsocketNetworkServer
+	metrics          *Metrics
 }
 
-func NewPeerPool(config *AppConfig) *PeerPool {
+func NewPeerPool(server *WebsocketNetworkServer, config *AppConfig) *PeerPool {
+	var metrics *Metrics
+	if server != nil {
+		metrics = server.metrics
+	}
 	return &PeerPool{
 		connections:      make([]*SignalingPeer, 0),
+		slots:            make(map[*SignalingPeer]int),
+		ids:              make(map[PeerId]*SignalingPeer),
 		servers:          make(map[string][]*SignalingPeer),
+		serverSlots:      make(map[*SignalingPeer]int),
+		locks:            make(map[string]*addressLock),
+		invites:          make(map[string]*Invite),
 		addressSharing:   config.AddressSharing,
 		maxAddressLength: 256,
 		appConfig:        config,
+		server:           server,
+		metrics:          metrics,
 	}
 }
 
@@ -28,8 +50,36 @@ func (pp *PeerPool) hasAddressSharing() bool {
 	return pp.addressSharing
 }
 
-func (pp *PeerPool) add(conn *websocket.Conn) {
-	pp.connections = append(pp.connections, NewSignalingPeer(pp, conn))
+func (pp *PeerPool) add(conn *websocket.Conn, reader *bufio.Reader, u upgrade) *SignalingPeer {
+	sp := NewSignalingPeer(pp, conn, reader)
+	sp.trace = u.trace
+	sp.claims = u.claims
+	sp.ip = u.ip
+	if u.remote != "" {
+		sp.connInfo = u.remote
+	}
+	sp.ipLimit = u.ipLimit
+	pp.mu.Lock()
+	pp.slots[sp] = len(pp.connections)
+	pp.connections = append(pp.connections, sp)
+	pp.ids[sp.id] = sp
+	sp.state = SignalingConnectionStateConnected
+	sp.expireSession()
+	if sp.taps().enabled() {
+		sp.publish(TapEvent{Kind: TapConnected}, nil)
+	}
+	pp.mu.Unlock()
+
+	sp.run()
+	sp.log(LevelInfo, "peer connected", F("local", sp.socket.LocalAddr().String()))
+	return sp
+}
+
+// peers returns a snapshot of the connected peers.
+func (pp *PeerPool) peers() []*SignalingPeer {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return append([]*SignalingPeer(nil), pp.connections...)
 }
 
 func (pp *PeerPool) getServerConnection(address string) []*SignalingPeer {
@@ -41,7 +91,7 @@ func (pp *PeerPool) getServerConnection(address string) []*SignalingPeer {
 
 func (pp *PeerPool) isAddressAvailable(address string) bool {
 	_, ok := pp.servers[address]
-	if len(address) <= pp.maxAddressLength && (ok || pp.addressSharing) {
+	if len(address) <= pp.maxAddressLength && (!ok || pp.addressSharing) {
 		return true
 	}
 	return false
@@ -51,6 +101,7 @@ func (pp *PeerPool) addServer(sp *SignalingPeer, address string) {
 	if _, ok := pp.servers[address]; !ok {
 		pp.servers[address] = make([]*SignalingPeer, 0)
 	}
+	pp.serverSlots[sp] = len(pp.servers[address])
 	pp.servers[address] = append(pp.servers[address], sp)
 }
 
@@ -60,28 +111,37 @@ func (pp *PeerPool) removeServer(sp *SignalingPeer, address string) {
 		return
 	}
 
-	for i := 0; i < len(servers); i++ {
-		if servers[i].connInfo != sp.connInfo {
-			continue
-		}
-		pp.servers[address] = append(pp.servers[address][0:i], pp.servers[address][i+1:]...)
-		break
+	if i, ok := pp.serverSlots[sp]; ok && i < len(servers) && servers[i] == sp {
+		pp.servers[address] = removeSlot(servers, pp.serverSlots, i)
+		delete(pp.serverSlots, sp)
 	}
 
 	if len(pp.servers[address]) == 0 {
 		delete(pp.servers, address)
-		log.Printf("Address %s released.", address)
+		pp.unlockAddress(address)
+		pp.server.logScoped(LevelInfo, pp.appConfig.AppName, address, "address released",
+			F("app", pp.appConfig.AppName), F("address", address))
 	}
 }
 
 func (pp *PeerPool) removeConnection(sp *SignalingPeer) {
-	for i := 0; i < len(pp.connections); i++ {
-		if pp.connections[i].connInfo != sp.connInfo {
-			continue
-		}
-		pp.connections = append(pp.connections[0:i], pp.connections[i+1:]...)
-		break
+	if i, ok := pp.slots[sp]; ok {
+		pp.connections = removeSlot(pp.connections, pp.slots, i)
+		delete(pp.slots, sp)
+		delete(pp.ids, sp.id)
+	}
+}
+
+// removeSlot moves the last peer into slot i and updates its index, the order
+// of peers in a pool or address is not significant.
+func removeSlot(peers []*SignalingPeer, slots map[*SignalingPeer]int, i int) []*SignalingPeer {
+	last := len(peers) - 1
+	if i != last {
+		peers[i] = peers[last]
+		slots[peers[i]] = i
 	}
+	peers[last] = nil
+	return peers[:last]
 }
 
 func (pp *PeerPool) count() int {
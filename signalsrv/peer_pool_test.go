@@ -0,0 +1,22 @@
+package signalsrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsAddressAvailable(t *testing.T) {
+	for _, sharing := range []bool{false, true} {
+		pp := NewPeerPool(nil, &AppConfig{AppName: "Test", AddressSharing: sharing})
+		if !pp.isAddressAvailable("room") {
+			t.Errorf("expected a free address to be available with sharing %v", sharing)
+		}
+		pp.addServer(nil, "room")
+		if want, got := sharing, pp.isAddressAvailable("room"); want != got {
+			t.Errorf("expected %v for a taken address with sharing %v got: %v", want, sharing, got)
+		}
+		if pp.isAddressAvailable(strings.Repeat("a", 257)) {
+			t.Error("expected a too long address to be unavailable")
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package signalsrv
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pinger sends the keepalive pings of all low memory peers from a single
+// goroutine instead of one writePump per peer.
+type pinger struct {
+	mu    sync.Mutex
+	peers map[*SignalingPeer]struct{}
+	// lastTick is the UnixNano time the loop last started a round.
+	lastTick int64
+}
+
+func newPinger(ctx context.Context) *pinger {
+	p := &pinger{
+		peers:    make(map[*SignalingPeer]struct{}),
+		lastTick: time.Now().UnixNano(),
+	}
+	go p.run(ctx)
+	return p
+}
+
+func (p *pinger) add(sp *SignalingPeer) {
+	p.mu.Lock()
+	p.peers[sp] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *pinger) remove(sp *SignalingPeer) {
+	p.mu.Lock()
+	delete(p.peers, sp)
+	p.mu.Unlock()
+}
+
+func (p *pinger) run(ctx context.Context) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		atomic.StoreInt64(&p.lastTick, time.Now().UnixNano())
+
+		p.mu.Lock()
+		peers := make([]*SignalingPeer, 0, len(p.peers))
+		for sp := range p.peers {
+			peers = append(peers, sp)
+		}
+		p.mu.Unlock()
+
+		for _, sp := range peers {
+			sp.ping()
+		}
+	}
+}
+
+// responsive reports whether the loop started a round recently, a round may
+// take a while with many peers.
+func (p *pinger) responsive(timeout time.Duration) bool {
+	last := time.Unix(0, atomic.LoadInt64(&p.lastTick))
+	return time.Since(last) < 2*pingPeriod+timeout
+}
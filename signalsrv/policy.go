@@ -0,0 +1,146 @@
+package signalsrv
+
+import (
+	"strings"
+	"time"
+)
+
+// Policy limits the addresses an authenticated peer may use. It applies to
+// tokens without their own listen or connect claims.
+type Policy struct {
+	// Listen and Connect are address patterns. * matches any run of
+	// characters, {sub} and {tenant} are replaced by the claims of the peer,
+	// e.g. "user:{sub}:*". Nil allows every address.
+	Listen  []string
+	Connect []string
+	// NoListenRoles are roles that may not listen at all, like "guest".
+	NoListenRoles []string
+}
+
+// applyPolicy fills in the listen and connect patterns the token didn't set.
+func (c *Claims) applyPolicy(p Policy) {
+	if c.Listen == nil {
+		c.Listen = p.Listen
+	}
+	if c.Connect == nil {
+		c.Connect = p.Connect
+	}
+	for _, role := range c.Roles {
+		for _, denied := range p.NoListenRoles {
+			if role == denied {
+				c.Listen = []string{}
+			}
+		}
+	}
+}
+
+// Actions checked against the claims of a peer.
+const (
+	ActionListen  = "listen"
+	ActionConnect = "connect"
+)
+
+// anyClaims matches patterns without placeholders.
+var anyClaims = &Claims{}
+
+// mayListen checks the claims of the peer and the reserved addresses of the
+// app.
+func (sp *SignalingPeer) mayListen(address string) bool {
+	for _, reserved := range sp.connectionPool.appConfig.ReservedAddresses {
+		if anyClaims.match(reserved, address) && (sp.claims == nil || !sp.claims.Reserved) {
+			return false
+		}
+	}
+	return sp.claims.MayListen(address)
+}
+
+// MayListen reports whether the claims allow ServerInitialized on address.
+func (c *Claims) MayListen(address string) bool {
+	return c == nil || c.allows(c.Listen, address)
+}
+
+// MayConnect reports whether the claims allow NewConnection to address.
+func (c *Claims) MayConnect(address string) bool {
+	return c == nil || c.allows(c.Connect, address)
+}
+
+func (c *Claims) allows(patterns []string, address string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, p := range patterns {
+		if c.match(p, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// match matches address against a pattern. The placeholders are replaced
+// after splitting at the wildcards, so a * in a claim is never a wildcard.
+func (c *Claims) match(pattern, address string) bool {
+	r := strings.NewReplacer("{sub}", c.Subject, "{tenant}", c.Tenant)
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = r.Replace(parts[i])
+	}
+	if len(parts) == 1 {
+		return address == parts[0]
+	}
+	if !strings.HasPrefix(address, parts[0]) {
+		return false
+	}
+	rest := address[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+// expireSession closes the peer once its token expires, with the same leeway
+// the token was accepted with. The timer doesn't cost a goroutine while it
+// waits. The pool must be locked.
+func (sp *SignalingPeer) expireSession() {
+	if sp.claims == nil || sp.claims.ExpiresAt.IsZero() {
+		return
+	}
+	expires := sp.claims.ExpiresAt.Add(sp.connectionPool.appConfig.Auth.leeway())
+	sp.expiry = time.AfterFunc(time.Until(expires), func() {
+		sp.Close(DisconnectTokenExpired)
+	})
+}
+
+// denied counts and logs an action the claims of the peer don't allow.
+func (sp *SignalingPeer) denied(action, address string) {
+	sp.connectionPool.metrics.countDenied(sp.app(), action)
+	sp.logScoped(LevelWarn, address, "not authorized", F("action", action))
+}
+
+// refuseListen returns why the peer may not listen on address, empty if it
+// may. A refusal is counted and logged.
+func (sp *SignalingPeer) refuseListen(address string) string {
+	if !sp.mayListen(address) {
+		sp.denied(ActionListen, address)
+		return TapReasonDenied
+	}
+	if sp.bannedAddress(address) {
+		return TapReasonBanned
+	}
+	return ""
+}
+
+// refuseConnect is refuseListen for connecting to address.
+func (sp *SignalingPeer) refuseConnect(address string) string {
+	if !sp.claims.MayConnect(address) {
+		sp.denied(ActionConnect, address)
+		return TapReasonDenied
+	}
+	if sp.bannedAddress(address) {
+		return TapReasonBanned
+	}
+	return ""
+}
@@ -0,0 +1,151 @@
+package signalsrv
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClaimsMatch(t *testing.T) {
+	c := &Claims{Subject: "alice", Tenant: "acme"}
+	tests := []struct {
+		pattern, address string
+		want             bool
+	}{
+		{"room", "room", true},
+		{"room", "room2", false},
+		{"*", "anything", true},
+		{"user:{sub}", "user:alice", true},
+		{"user:{sub}", "user:bob", false},
+		{"user:{sub}:*", "user:alice:call", true},
+		{"user:{sub}:*", "user:alice", false},
+		{"{tenant}/*/lobby", "acme/eu/lobby", true},
+		{"{tenant}/*/lobby", "acme/eu/hall", false},
+		{"*:{sub}:*", "x:alice:y", true},
+	}
+	for _, test := range tests {
+		if want, got := test.want, c.match(test.pattern, test.address); want != got {
+			t.Errorf("expected %v for %q on %q got: %v", want, test.pattern, test.address, got)
+		}
+	}
+
+	// a wildcard in a claim matches literally
+	star := &Claims{Subject: "*"}
+	if star.match("user:{sub}", "user:alice") {
+		t.Error("expected a * subject to match literally")
+	}
+
+	var anonymous *Claims
+	if !anonymous.MayListen("room") || !anonymous.MayConnect("room") {
+		t.Error("expected peers without claims to be unrestricted")
+	}
+	guest := &Claims{Subject: "g", Roles: []string{"guest"}}
+	guest.applyPolicy(Policy{NoListenRoles: []string{"guest"}})
+	if guest.MayListen("room") || !guest.MayConnect("room") {
+		t.Errorf("expected a guest to only connect got: %+v", guest)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	auth, err := NewAuthenticator(AuthConfig{
+		Secrets: map[string][]byte{"": []byte("secret")},
+		Policy: Policy{
+			Listen:        []string{"user:{sub}:*"},
+			Connect:       []string{"user:*"},
+			NoListenRoles: []string{"guest"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Auth: auth})
+	defer closeServer()
+	dial := func(claims map[string]interface{}) *testClient {
+		return dialTestClient(t, url+"?token="+signToken(t, "HS256", "", []byte("secret"), claims))
+	}
+
+	alice := dial(map[string]interface{}{"sub": "alice"})
+	defer alice.conn.Close()
+	alice.send(t, NetEventTypeServerInitialized, -1, "user:bob:call")
+	alice.expect(t, NetEventTypeServerInitFailed)
+	alice.send(t, NetEventTypeServerInitialized, -1, "user:alice:call")
+	alice.expect(t, NetEventTypeServerInitialized)
+
+	guest := dial(map[string]interface{}{"sub": "g1", "roles": []string{"guest"}})
+	defer guest.conn.Close()
+	guest.send(t, NetEventTypeServerInitialized, -1, "user:g1:call")
+	guest.expect(t, NetEventTypeServerInitFailed)
+	guest.send(t, NetEventTypeNewConnection, 1, "lobby")
+	if want, got := int16(1), guest.expect(t, NetEventTypeConnectionFailed).ConnectionId.ID; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	guest.send(t, NetEventTypeNewConnection, 2, "user:alice:call")
+	guest.expect(t, NetEventTypeNewConnection)
+	alice.expect(t, NetEventTypeNewConnection)
+
+	// the token's own claims take precedence over the policy
+	lobby := dial(map[string]interface{}{"sub": "mod", "listen": []string{"lobby"}})
+	defer lobby.conn.Close()
+	lobby.send(t, NetEventTypeServerInitialized, -1, "lobby")
+	lobby.expect(t, NetEventTypeServerInitialized)
+
+	rec := httptest.NewRecorder()
+	wns.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`awsignal_denied_total{app="Test",action="listen"} 2`,
+		`awsignal_denied_total{app="Test",action="connect"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected metrics to contain %q got:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	auth, err := NewAuthenticator(AuthConfig{Secrets: map[string][]byte{"": []byte("secret")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Auth: auth})
+	defer closeServer()
+	exp := float64(time.Now().Add(300*time.Millisecond).UnixNano()) / float64(time.Second)
+	token := signToken(t, "HS256", "", []byte("secret"), map[string]interface{}{"sub": "alice", "exp": exp})
+
+	listener := dialTestClient(t, url+"?token="+signToken(t, "HS256", "", []byte("secret"), map[string]interface{}{"sub": "bob"}))
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room")
+	listener.expect(t, NetEventTypeServerInitialized)
+
+	c := dialTestClient(t, url+"?token="+token)
+	c.send(t, NetEventTypeNewConnection, 1, "room")
+	c.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+
+	c.expectClose(t, websocket.ClosePolicyViolation)
+	listener.expect(t, NetEventTypeDisconnected)
+}
+
+func TestTokenExpiryLeeway(t *testing.T) {
+	auth, err := NewAuthenticator(AuthConfig{Secrets: map[string][]byte{"": []byte("secret")}, Leeway: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Auth: auth})
+	defer closeServer()
+	// expired, but within the leeway
+	exp := float64(time.Now().Add(-100*time.Millisecond).UnixNano()) / float64(time.Second)
+	c := dialTestClient(t, url+"?token="+signToken(t, "HS256", "", []byte("secret"), map[string]interface{}{"sub": "alice", "exp": exp}))
+	defer c.conn.Close()
+	start := time.Now()
+	c.send(t, NetEventTypeServerInitialized, -1, "room")
+	c.expect(t, NetEventTypeServerInitialized)
+	c.expectNone(t, 150*time.Millisecond)
+
+	c.expectClose(t, websocket.ClosePolicyViolation)
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("expected the session to last until the leeway ran out got: %s", d)
+	}
+}
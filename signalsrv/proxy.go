@@ -0,0 +1,273 @@
+package signalsrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var proxyHeaderTimeout = 5 * time.Second
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ParseCIDRs parses IP ranges like "10.0.0.0/8", a single IP is a range of
+// one.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		network, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	cidr := s
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errors.Errorf("invalid ip or cidr %q", s)
+	}
+	return network, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIP parses the IP of an address with or without a port.
+func hostIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// remoteAddr is the address of the client of r. A request from a trusted
+// proxy is attributed to the rightmost address of its Forwarded or
+// X-Forwarded-For header that isn't a trusted proxy itself.
+func (wns *WebsocketNetworkServer) remoteAddr(r *http.Request) string {
+	trusted := wns.config.TrustedProxies
+	if !containsIP(trusted, hostIP(r.RemoteAddr)) {
+		return r.RemoteAddr
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hostIP(hops[i]) == nil {
+			// obfuscated or garbage, nothing left of it can be trusted
+			break
+		}
+		if i == 0 || !containsIP(trusted, hostIP(hops[i])) {
+			return hops[i]
+		}
+	}
+	return r.RemoteAddr
+}
+
+// forwardedFor lists the client addresses of the Forwarded header, or of
+// X-Forwarded-For without one, from the client to the last proxy.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if values := header["Forwarded"]; len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// ProxyListener accepts connections that start with a PROXY protocol v1 or
+// v2 header, like those of HAProxy or a cloud load balancer, and reports the
+// client address of the header as their RemoteAddr.
+type ProxyListener struct {
+	net.Listener
+	// Trusted are the proxies allowed to connect, empty allows any.
+	Trusted []*net.IPNet
+}
+
+func NewProxyListener(l net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{Listener: l, Trusted: trusted}
+}
+
+// Accept doesn't wait for the header, it is read by the first Read or
+// RemoteAddr of the connection.
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, trusted: l.Trusted}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	trusted []*net.IPNet
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+// init reads the header. A connection without a valid header is closed
+// before anything is written to it.
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if len(c.trusted) > 0 && !containsIP(c.trusted, hostIP(c.remote.String())) {
+			c.err = errors.Errorf("proxy protocol: %s is not a trusted proxy", c.remote)
+			c.Conn.Close()
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		remote, err := readProxyHeader(c.Conn)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = errors.Wrap(err, "proxy protocol")
+			c.Conn.Close()
+			return
+		}
+		if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// SyscallConn exposes the socket to netpoll. The header is read without
+// buffering, so nothing of the stream is left behind.
+func (c *proxyConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("connection has no file descriptor")
+	}
+	return sc.SyscallConn()
+}
+
+// readProxyHeader reads exactly the header from r. It returns a nil address
+// for headers without a client address, like health checks of the proxy.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// the shortest v1 header is 15 bytes, so this never reads past it
+	start := make([]byte, 5)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	switch {
+	case string(start) == "PROXY":
+		return readProxyV1(r)
+	case bytes.Equal(start, proxySignature[:5]):
+		return readProxyV2(r)
+	}
+	return nil, errors.New("missing header")
+}
+
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	line := make([]byte, 0, 107)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 102 {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, errors.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[1])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	head := make([]byte, 11)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:7], proxySignature[5:]) {
+		return nil, errors.New("missing header")
+	}
+	if head[7]>>4 != 2 {
+		return nil, errors.Errorf("unsupported version %d", head[7]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[9:11]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL connections come from the proxy itself
+	if head[7]&0x0f == 0 {
+		return nil, nil
+	}
+	switch head[8] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("short v2 ipv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("short v2 ipv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// unix sockets and unspecified families keep the proxy address
+	return nil, nil
+}
@@ -0,0 +1,158 @@
+package signalsrv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRemoteAddr(t *testing.T) {
+	proxies, err := ParseCIDRs([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0/40"}); err == nil {
+		t.Error("expected an invalid cidr to fail")
+	}
+	wns := &WebsocketNetworkServer{config: &ServerConfig{TrustedProxies: proxies}}
+	tests := []struct {
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"192.0.2.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "192.0.2.1:1000"},
+		{"10.0.0.1:1000", nil, "10.0.0.1:1000"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7", "10.0.0.2"}}, "198.51.100.7"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"10.0.0.1:1000", http.Header{"X-Forwarded-For": {"nope, 10.0.0.2"}}, "10.0.0.1:1000"},
+		{"[::1]:1000", http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}}, "[2001:db8::1]:4711"},
+		{"[::1]:1000", http.Header{"Forwarded": {"for=_hidden"}, "X-Forwarded-For": {"198.51.100.7"}}, "[::1]:1000"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.header {
+			r.Header[k] = v
+		}
+		if want, got := test.want, wns.remoteAddr(r); want != got {
+			t.Errorf("expected %s for %s %v got: %s", want, test.remote, test.header, got)
+		}
+	}
+}
+
+func TestForwardedPeer(t *testing.T) {
+	proxies, _ := ParseCIDRs([]string{"127.0.0.1"})
+	bans, _ := NewBanList("")
+	wns, url, closeServer := newTestServer(t, &ServerConfig{TrustedProxies: proxies, Bans: bans}, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+	dial := func(client string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {client}})
+		if err != nil {
+			if resp == nil {
+				t.Fatal(err)
+			}
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	conn, _ := dial("198.51.100.7")
+	if conn == nil {
+		t.Fatal("expected the upgrade to succeed")
+	}
+	defer conn.Close()
+	peers := testPeers(wns, "Test", "")
+	if len(peers) != 1 || peers[0].Remote != "198.51.100.7" {
+		t.Errorf("expected the forwarded client got: %+v", peers)
+	}
+
+	bans.Add(Ban{Kind: BanIP, Value: "198.51.100.0/24"}, 0)
+	if _, status := dial("198.51.100.8"); status != http.StatusForbidden {
+		t.Errorf("expected %d got: %d", http.StatusForbidden, status)
+	}
+	other, status := dial("192.0.2.1")
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected %d got: %d", http.StatusSwitchingProtocols, status)
+	}
+	other.Close()
+}
+
+func proxyV2Header(ip net.IP, port uint16) []byte {
+	header := append([]byte(nil), proxySignature...)
+	body := make([]byte, 12)
+	copy(body, ip.To4())
+	copy(body[4:], net.IPv4(10, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(body[8:], port)
+	binary.BigEndian.PutUint16(body[10:], 8000)
+	// a TLV after the addresses is skipped
+	body = append(body, 0x04, 0x00, 0x01, 0xff)
+	header = append(header, 0x21, 0x11, 0, byte(len(body)))
+	return append(header, body...)
+}
+
+// proxyGet sends a request after header to a server behind a ProxyListener,
+// the server answers with the remote address of the request.
+func proxyGet(t *testing.T, trusted []*net.IPNet, header []byte) (string, error) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	ts.Listener = NewProxyListener(ts.Listener, trusted)
+	ts.Start()
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write(append(header, "GET / HTTP/1.0\r\n\r\n"...))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestProxyProtocol(t *testing.T) {
+	tests := []struct {
+		header []byte
+		want   string
+	}{
+		{[]byte("PROXY TCP4 198.51.100.7 10.0.0.1 5000 8000\r\n"), "198.51.100.7:5000"},
+		{[]byte("PROXY TCP6 2001:db8::1 ::1 5000 8000\r\n"), "[2001:db8::1]:5000"},
+		{[]byte("PROXY UNKNOWN\r\n"), "127.0.0.1:"},
+		{proxyV2Header(net.IPv4(198, 51, 100, 9), 6000), "198.51.100.9:6000"},
+	}
+	for _, test := range tests {
+		got, err := proxyGet(t, nil, test.header)
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+			continue
+		}
+		if !strings.HasPrefix(got, test.want) {
+			t.Errorf("expected %s got: %s", test.want, got)
+		}
+	}
+	for _, header := range []string{"", "PROXY TCP4 nope\r\n"} {
+		if _, err := proxyGet(t, nil, []byte(header)); err == nil {
+			t.Errorf("expected %q to be rejected", header)
+		}
+	}
+
+	untrusted, _ := ParseCIDRs([]string{"192.0.2.1"})
+	if _, err := proxyGet(t, untrusted, tests[0].header); err == nil {
+		t.Error("expected an untrusted proxy to be rejected")
+	}
+}
@@ -0,0 +1,294 @@
+package signalsrv
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// LimitAction is what happens to the events of a peer over its rate limits.
+type LimitAction string
+
+const (
+	// LimitDrop drops the event and warns the client at most once a second.
+	LimitDrop LimitAction = "drop"
+	// LimitDelay stops reading from the peer until the event is within the
+	// limits, which pushes back on the client through TCP. A single wait is
+	// capped at half of pongWait and doesn't count against the keepalive.
+	LimitDelay LimitAction = "delay"
+	// LimitDisconnect closes the peer with the policy violation close code.
+	LimitDisconnect LimitAction = "disconnect"
+)
+
+// Reasons counted for upgrades over the per-IP connection limits.
+const (
+	RejectConnectionRate  = "connection_rate"
+	RejectConnectionCount = "connection_count"
+)
+
+var (
+	ipLimitSweepInterval = time.Minute
+	errRateLimited       = errors.New("rate limited")
+)
+
+// RateLimits are the token bucket limits of an app. A zero rate disables a
+// limit, a zero burst allows one second worth of the rate.
+type RateLimits struct {
+	// MessagesPerSecond and BytesPerSecond limit the events a peer sends.
+	MessagesPerSecond float64
+	MessageBurst      int
+	BytesPerSecond    float64
+	ByteBurst         int
+	// Action applies to events over the message or byte limits, the
+	// default is LimitDrop.
+	Action LimitAction
+	// ConnectionsPerSecond limits the upgrade attempts of an IP.
+	ConnectionsPerSecond float64
+	ConnectionBurst      int
+	// MaxConnectionsPerIP limits the concurrent peers of an IP.
+	MaxConnectionsPerIP int
+}
+
+// tokenBucket is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// has reports whether n tokens are available, a nil bucket is unlimited. More
+// than the burst is available once the bucket is full, taking it leaves the
+// bucket in debt.
+func (b *tokenBucket) has(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	if n > b.burst {
+		n = b.burst
+	}
+	return b.tokens >= n
+}
+
+// take removes n tokens, the bucket may go into debt. It returns how long it
+// takes until the debt is paid off.
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// forgive limits the debt to what is paid off within d.
+func (b *tokenBucket) forgive(d time.Duration) {
+	if b == nil {
+		return
+	}
+	if min := -d.Seconds() * b.rate; b.tokens < min {
+		b.tokens = min
+	}
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// peerLimiter limits the inbound events of one peer. It is only used by the
+// reader of the peer.
+type peerLimiter struct {
+	action   LimitAction
+	messages *tokenBucket
+	bytes    *tokenBucket
+	warned   time.Time
+}
+
+func newPeerLimiter(limits *RateLimits) *peerLimiter {
+	if limits == nil || (limits.MessagesPerSecond <= 0 && limits.BytesPerSecond <= 0) {
+		return nil
+	}
+	action := limits.Action
+	if action == "" {
+		action = LimitDrop
+	}
+	return &peerLimiter{
+		action:   action,
+		messages: newTokenBucket(limits.MessagesPerSecond, limits.MessageBurst),
+		bytes:    newTokenBucket(limits.BytesPerSecond, limits.ByteBurst),
+	}
+}
+
+// limit applies the limits to an inbound event of size bytes. It returns
+// false if the event is dropped and errRateLimited if the peer has to go.
+func (sp *SignalingPeer) limit(size int) (bool, error) {
+	l := sp.limiter
+	now := time.Now()
+	if l.action != LimitDelay && l.messages.has(now, 1) && l.bytes.has(now, float64(size)) {
+		l.messages.take(1)
+		l.bytes.take(float64(size))
+		return true, nil
+	}
+	if l.action == LimitDelay {
+		l.messages.refill(now)
+		l.bytes.refill(now)
+		wait := l.messages.take(1)
+		if w := l.bytes.take(float64(size)); w > wait {
+			wait = w
+		}
+		// a peer that waits longer would miss its pongs
+		if max := pongWait / 2; wait > max {
+			l.messages.forgive(max)
+			l.bytes.forgive(max)
+			wait = max
+		}
+		if wait > 0 {
+			sp.connectionPool.metrics.countLimited(sp.app(), l.action)
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-sp.ctx.Done():
+				return false, nil
+			}
+			// the peer is alive, the wait mustn't count against its pongs
+			if sp.polled {
+				atomic.StoreInt64(&sp.lastPong, time.Now().UnixNano())
+			} else {
+				sp.socket.SetReadDeadline(time.Now().Add(pongWait))
+			}
+		}
+		return true, nil
+	}
+
+	sp.connectionPool.metrics.countLimited(sp.app(), l.action)
+	if l.action == LimitDisconnect {
+		return false, errRateLimited
+	}
+	if now.Sub(l.warned) >= time.Second {
+		l.warned = now
+		msg := "rate limited, events are dropped"
+		pool := sp.connectionPool
+		pool.mu.Lock()
+		sp.sendToClient(NewNetworkEvent(NetEventTypeWarning, INVALIDConnectionId,
+			&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &msg}))
+		pool.mu.Unlock()
+	}
+	return false, nil
+}
+
+// ipLimiter limits the upgrade attempts and the concurrent peers per IP of
+// an app.
+type ipLimiter struct {
+	limits *RateLimits
+	mu     sync.Mutex
+	ips    map[string]*ipState
+	swept  time.Time
+}
+
+type ipState struct {
+	attempts *tokenBucket
+	peers    int
+}
+
+func newIPLimiter(limits *RateLimits) *ipLimiter {
+	return &ipLimiter{limits: limits, ips: make(map[string]*ipState), swept: time.Now()}
+}
+
+// acquire counts an upgrade attempt of ip. If it is allowed, the caller has
+// to release ip once the peer is gone or the upgrade failed.
+func (l *ipLimiter) acquire(ip string) (bool, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	s, ok := l.ips[ip]
+	if !ok {
+		s = &ipState{attempts: newTokenBucket(l.limits.ConnectionsPerSecond, l.limits.ConnectionBurst)}
+		l.ips[ip] = s
+	}
+	if !s.attempts.has(now, 1) {
+		return false, RejectConnectionRate
+	}
+	s.attempts.take(1)
+	if l.limits.MaxConnectionsPerIP > 0 && s.peers >= l.limits.MaxConnectionsPerIP {
+		return false, RejectConnectionCount
+	}
+	s.peers++
+	return true, ""
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.ips[ip]; ok && s.peers > 0 {
+		s.peers--
+	}
+}
+
+// sweep forgets the IPs without peers whose attempts bucket is full again.
+func (l *ipLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < ipLimitSweepInterval {
+		return
+	}
+	l.swept = now
+	for ip, s := range l.ips {
+		if s.peers == 0 && (s.attempts == nil || s.attempts.full(now)) {
+			delete(l.ips, ip)
+		}
+	}
+}
+
+// ipLimiter returns the per IP limiter of the app, nil if it has none.
+func (wns *WebsocketNetworkServer) ipLimiter(config *AppConfig) *ipLimiter {
+	limits := config.Limits
+	if limits == nil || (limits.ConnectionsPerSecond <= 0 && limits.MaxConnectionsPerIP <= 0) {
+		return nil
+	}
+	wns.mu.Lock()
+	defer wns.mu.Unlock()
+	l, ok := wns.ipLimits[config.AppName]
+	if !ok {
+		l = newIPLimiter(limits)
+		wns.ipLimits[config.AppName] = l
+	}
+	return l
+}
+
+// clientIP is the IP the limits and bans of a request apply to, the request
+// must already carry the remoteAddr of its client.
+func clientIP(r *http.Request) string {
+	if ip := hostIP(r.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,193 @@
+package signalsrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if b := newTokenBucket(0, 10); b != nil || !b.has(time.Now(), 100) {
+		t.Error("expected a zero rate to be unlimited")
+	}
+	b := newTokenBucket(10, 2)
+	now := b.last
+	for i := 0; i < 2; i++ {
+		if !b.has(now, 1) {
+			t.Fatalf("expected token %d within the burst", i)
+		}
+		b.take(1)
+	}
+	if b.has(now, 1) {
+		t.Error("expected the burst to be used up")
+	}
+	if !b.has(now.Add(100*time.Millisecond), 1) {
+		t.Error("expected a token after 100ms")
+	}
+	if want, got := 200*time.Millisecond, b.take(3); want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if b.full(now.Add(300 * time.Millisecond)) {
+		t.Error("expected the debt to be paid off first")
+	}
+
+	b = newTokenBucket(10, 2)
+	if !b.has(b.last, 5) {
+		t.Error("expected more than the burst from a full bucket")
+	}
+	b.take(5)
+	if b.has(b.last.Add(200*time.Millisecond), 1) {
+		t.Error("expected the debt of an oversized take to be paid off first")
+	}
+	b.forgive(100 * time.Millisecond)
+	if !b.has(b.last.Add(200*time.Millisecond), 1) {
+		t.Error("expected the forgiven debt to be paid off")
+	}
+}
+
+func limitedClient(t *testing.T, limits *RateLimits) (*WebsocketNetworkServer, *testClient, func()) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Limits: limits})
+	c := dialTestClient(t, url)
+	return wns, c, func() {
+		c.conn.Close()
+		closeServer()
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	wns, c, done := limitedClient(t, &RateLimits{MessagesPerSecond: 1, MessageBurst: 2})
+	defer done()
+	for i := int16(1); i <= 4; i++ {
+		c.send(t, NetEventTypeNewConnection, i, "nobody")
+	}
+	c.expect(t, NetEventTypeConnectionFailed)
+	c.expect(t, NetEventTypeConnectionFailed)
+	c.expect(t, NetEventTypeWarning)
+	c.expectNone(t, 100*time.Millisecond)
+
+	if want, text := `awsignal_rate_limited_total{app="Test",action="drop"} 2`, metricsText(wns); !strings.Contains(text, want) {
+		t.Errorf("expected metrics to contain %q got:\n%s", want, text)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	_, c, done := limitedClient(t, &RateLimits{BytesPerSecond: 1000, ByteBurst: 100, Action: LimitDelay})
+	defer done()
+	start := time.Now()
+	for i := int16(1); i <= 3; i++ {
+		c.send(t, NetEventTypeNewConnection, i, strings.Repeat("x", 40))
+	}
+	for i := 0; i < 3; i++ {
+		c.expect(t, NetEventTypeConnectionFailed)
+	}
+	// each event is about 90 bytes, the last two wait for 80ms
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected the events to be delayed got: %s", d)
+	}
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	_, c, done := limitedClient(t, &RateLimits{MessagesPerSecond: 1, MessageBurst: 1, Action: LimitDisconnect})
+	defer done()
+	c.send(t, NetEventTypeNewConnection, 1, "nobody")
+	c.expect(t, NetEventTypeConnectionFailed)
+	c.send(t, NetEventTypeNewConnection, 2, "nobody")
+	c.expectClose(t, websocket.ClosePolicyViolation)
+}
+
+func TestRateLimitOversized(t *testing.T) {
+	defer func(ping, pong time.Duration) {
+		pingPeriod, pongWait = ping, pong
+	}(pingPeriod, pongWait)
+	pingPeriod, pongWait = 50*time.Millisecond, 300*time.Millisecond
+
+	offer := strings.Repeat("x", 200)
+	for _, action := range []LimitAction{LimitDrop, LimitDisconnect} {
+		_, c, done := limitedClient(t, &RateLimits{BytesPerSecond: 100, Action: action})
+		c.send(t, NetEventTypeNewConnection, 1, offer)
+		c.expect(t, NetEventTypeConnectionFailed)
+		done()
+	}
+
+	_, c, done := limitedClient(t, &RateLimits{BytesPerSecond: 10, Action: LimitDelay})
+	defer done()
+	start := time.Now()
+	for i := int16(1); i <= 3; i++ {
+		c.send(t, NetEventTypeNewConnection, i, offer)
+	}
+	for i := 0; i < 3; i++ {
+		c.expect(t, NetEventTypeConnectionFailed)
+	}
+	// each wait is capped at half of pongWait instead of 40s
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the delay to be capped got: %s", d)
+	}
+	c.expectNone(t, 2*pongWait)
+}
+
+func dialStatus(t *testing.T, url string) (*websocket.Conn, int) {
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		if resp == nil {
+			t.Fatal(err)
+		}
+		return nil, resp.StatusCode
+	}
+	return conn, http.StatusSwitchingProtocols
+}
+
+func TestConnectionsPerIP(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Limits: &RateLimits{MaxConnectionsPerIP: 1}})
+	defer closeServer()
+
+	first, status := dialStatus(t, url)
+	if want, got := http.StatusSwitchingProtocols, status; want != got {
+		t.Fatalf("expected %d got: %d", want, got)
+	}
+	if _, status := dialStatus(t, url); status != http.StatusTooManyRequests {
+		t.Errorf("expected %d got: %d", http.StatusTooManyRequests, status)
+	}
+	first.Close()
+	// the peer releases its ip once the server noticed the close
+	var second *websocket.Conn
+	for deadline := time.Now().Add(2 * time.Second); second == nil && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		second, status = dialStatus(t, url)
+	}
+	if second == nil {
+		t.Fatalf("expected a connection after the first one closed got: %d", status)
+	}
+	second.Close()
+
+	if want, text := `awsignal_rejected_upgrades_total{app="Test",reason="connection_count"}`, metricsText(wns); !strings.Contains(text, want) {
+		t.Errorf("expected metrics to contain %q got:\n%s", want, text)
+	}
+}
+
+func TestConnectionRate(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test", Limits: &RateLimits{ConnectionsPerSecond: 0.1, ConnectionBurst: 2}})
+	defer closeServer()
+	for i := 0; i < 2; i++ {
+		conn, status := dialStatus(t, url)
+		if want, got := http.StatusSwitchingProtocols, status; want != got {
+			t.Fatalf("expected %d got: %d", want, got)
+		}
+		conn.Close()
+	}
+	if _, status := dialStatus(t, url); status != http.StatusTooManyRequests {
+		t.Errorf("expected %d got: %d", http.StatusTooManyRequests, status)
+	}
+	if want, text := `awsignal_rejected_upgrades_total{app="Test",reason="connection_rate"} 1`, metricsText(wns); !strings.Contains(text, want) {
+		t.Errorf("expected metrics to contain %q got:\n%s", want, text)
+	}
+}
+
+func metricsText(wns *WebsocketNetworkServer) string {
+	rec := httptest.NewRecorder()
+	wns.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
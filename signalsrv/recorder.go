@@ -0,0 +1,489 @@
+package signalsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const recordQueueSize = 4096
+
+type RecorderConfig struct {
+	// Dir receives one JSONL file per recorded app or address.
+	Dir string
+	// MaxFileSize rotates a file once it grows past it, default 64MiB.
+	MaxFileSize int64
+	// MaxFiles is the number of files kept per scope including the current
+	// one, default 10.
+	MaxFiles int
+	// Unredacted keeps ICE candidates and SDP credentials in the payloads.
+	Unredacted bool
+	// Logger reports write errors, it defaults to a text logger on stderr.
+	Logger Logger
+}
+
+// Record is one recorded NetworkEvent. ByteArray payloads are stored as text
+// if they are UTF-16LE text, as awrtc sends its messages, or valid UTF-8,
+// otherwise base64 encoded.
+type Record struct {
+	Time         time.Time `json:"time"`
+	App          string    `json:"app"`
+	Address      string    `json:"address,omitempty"`
+	Peer         PeerId    `json:"peer"`
+	Direction    string    `json:"direction"`
+	Type         string    `json:"type"`
+	ConnectionId int16     `json:"connection_id"`
+	DataType     string    `json:"data_type"`
+	Data         *string   `json:"data,omitempty"`
+	Base64       bool      `json:"base64,omitempty"`
+	UTF16        bool      `json:"utf16,omitempty"`
+}
+
+func newRecord(sp *SignalingPeer, address, direction string, evt *NetworkEvent, redact bool) *Record {
+	r := &Record{
+		Time:      time.Now(),
+		App:       sp.app(),
+		Address:   address,
+		Peer:      sp.id,
+		Direction: direction,
+	}
+	r.setEvent(evt, redact)
+	return r
+}
+
+func (r *Record) setEvent(evt *NetworkEvent, redact bool) {
+	r.Type = NetEventTypeITS[evt.Type]
+	r.DataType = NetEventDataTypeNull.String()
+	if evt.ConnectionId != nil {
+		r.ConnectionId = evt.ConnectionId.ID
+	}
+	if evt.Data == nil {
+		return
+	}
+	r.DataType = evt.Data.Type.String()
+	evt = maskAccess(evt)
+	var data string
+	text, isUTF16 := decodeUTF16Text(evt.Data.ObjectData)
+	switch {
+	case evt.Data.Type == NetEventDataTypeUTF16String && evt.Data.StringData != nil:
+		data = *evt.Data.StringData
+	case evt.Data.Type == NetEventDataTypeByteArray && isUTF16:
+		data = text
+		r.UTF16 = true
+	case evt.Data.Type == NetEventDataTypeByteArray && utf8.Valid(evt.Data.ObjectData):
+		data = string(evt.Data.ObjectData)
+	case evt.Data.Type == NetEventDataTypeByteArray:
+		data = base64.StdEncoding.EncodeToString(evt.Data.ObjectData)
+		r.Base64 = true
+	default:
+		return
+	}
+	if redact && !r.Base64 {
+		data = Redact(data)
+	}
+	r.Data = &data
+}
+
+// Event rebuilds the recorded NetworkEvent.
+func (r *Record) Event() (*NetworkEvent, error) {
+	typ, ok := NetEventTypeSTI[r.Type]
+	if !ok {
+		return nil, errors.Errorf("unknown event type %q", r.Type)
+	}
+	dataType, ok := NetEventDataTypeMap[r.DataType]
+	if !ok {
+		return nil, errors.Errorf("unknown data type %q", r.DataType)
+	}
+	data := &NetEventData{Type: NetEventDataType(dataType)}
+	switch {
+	case r.Data == nil:
+	case data.Type == NetEventDataTypeUTF16String:
+		s := *r.Data
+		data.StringData = &s
+	case data.Type == NetEventDataTypeByteArray && r.Base64:
+		b, err := base64.StdEncoding.DecodeString(*r.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid base64 data")
+		}
+		data.ObjectData = b
+	case data.Type == NetEventDataTypeByteArray && r.UTF16:
+		data.ObjectData = encodeUTF16(*r.Data)
+	case data.Type == NetEventDataTypeByteArray:
+		data.ObjectData = []byte(*r.Data)
+	}
+	return NewNetworkEvent(typ, NewConnectionId(r.ConnectionId), data), nil
+}
+
+// decodeUTF16Text decodes b if it is UTF-16LE text. Such text usually
+// passes as UTF-8 too, but its NULs would hide it from Redact.
+func decodeUTF16Text(b []byte) (string, bool) {
+	if len(b) == 0 || len(b)%2 != 0 || bytes.IndexByte(b, 0) < 0 {
+		return "", false
+	}
+	units, err := toUint16Array(b)
+	if err != nil {
+		return "", false
+	}
+	for i := 0; i < len(units); i++ {
+		if !utf16.IsSurrogate(rune(units[i])) {
+			continue
+		}
+		if units[i] >= 0xdc00 || i+1 == len(units) || units[i+1] < 0xdc00 || units[i+1] > 0xdfff {
+			return "", false
+		}
+		i++
+	}
+	text := string(utf16.Decode(units))
+	for _, c := range text {
+		if unicode.IsControl(c) && c != '\t' && c != '\r' && c != '\n' {
+			return "", false
+		}
+	}
+	return text, true
+}
+
+func encodeUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[i*2:], u)
+	}
+	return b
+}
+
+var (
+	redactIPv4 = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// full and :: compressed IPv6 addresses, plain hh:mm:ss times don't match.
+	redactIPv6 = regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|\b[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*::(?:[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*\b)?|::[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*\b`)
+	// credentials and fingerprints up to the end of the SDP line or JSON string
+	redactSDP      = regexp.MustCompile(`(a=(?:ice-ufrag|ice-pwd|fingerprint|crypto):)[^\\\r\n"]*`)
+	redactUfrag    = regexp.MustCompile(`(\bufrag )[^\s\\"]+`)
+	redactJSONFrag = regexp.MustCompile(`("usernameFragment"\s*:\s*")[^"]*`)
+)
+
+// Redact masks IP addresses, ICE credentials and DTLS fingerprints in a
+// payload, e.g. an SDP offer or an ICE candidate. Redacting twice gives the
+// same result.
+func Redact(s string) string {
+	s = redactSDP.ReplaceAllString(s, "${1}[redacted]")
+	s = redactUfrag.ReplaceAllString(s, "${1}[redacted]")
+	s = redactJSONFrag.ReplaceAllString(s, "${1}[redacted]")
+	s = redactIPv4.ReplaceAllString(s, "x.x.x.x")
+	return redactIPv6.ReplaceAllString(s, "x::x")
+}
+
+type recordScope struct {
+	App     string `json:"app"`
+	Address string `json:"address,omitempty"`
+}
+
+type scopedRecord struct {
+	scope  recordScope
+	record *Record
+}
+
+// Recorder writes the events of the enabled apps and addresses to rotating
+// JSONL files. Events are written by a single goroutine, they are dropped
+// instead of slowing down a peer while its queue is full.
+type Recorder struct {
+	config  RecorderConfig
+	mu      sync.RWMutex
+	scopes  map[recordScope]bool
+	active  int32
+	records chan scopedRecord
+	files   map[recordScope]*recordFile
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped uint64
+}
+
+func NewRecorder(config RecorderConfig) (*Recorder, error) {
+	if config.MaxFileSize <= 0 {
+		config.MaxFileSize = 64 << 20
+	}
+	if config.MaxFiles <= 0 {
+		config.MaxFiles = 10
+	}
+	if config.Logger == nil {
+		config.Logger = NewTextLogger(os.Stderr)
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create record dir")
+	}
+	r := &Recorder{
+		config:  config,
+		scopes:  make(map[recordScope]bool),
+		records: make(chan scopedRecord, recordQueueSize),
+		files:   make(map[recordScope]*recordFile),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Enable records every peer of app, or with an address only the peers
+// listening on or connecting to it.
+func (r *Recorder) Enable(app, address string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scopes[recordScope{app, address}] = true
+	atomic.StoreInt32(&r.active, int32(len(r.scopes)))
+}
+
+func (r *Recorder) Disable(app, address string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.scopes, recordScope{app, address})
+	atomic.StoreInt32(&r.active, int32(len(r.scopes)))
+}
+
+// Dropped is the number of records lost because the queue was full.
+func (r *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+// Close writes the queued records and closes the files.
+func (r *Recorder) Close() error {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+	return nil
+}
+
+func (r *Recorder) record(sp *SignalingPeer, direction string, evt *NetworkEvent) {
+	if r == nil || atomic.LoadInt32(&r.active) == 0 {
+		return
+	}
+	app, address := sp.app(), sp.eventAddress(evt)
+	var matched []recordScope
+	r.mu.RLock()
+	for _, scope := range []recordScope{{app, ""}, {app, address}} {
+		if r.scopes[scope] && (len(matched) == 0 || matched[0] != scope) {
+			matched = append(matched, scope)
+		}
+	}
+	r.mu.RUnlock()
+	if len(matched) == 0 {
+		return
+	}
+	rec := newRecord(sp, address, direction, evt, !r.config.Unredacted)
+	for _, scope := range matched {
+		select {
+		case r.records <- scopedRecord{scope, rec}:
+		default:
+			atomic.AddUint64(&r.dropped, 1)
+		}
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	defer func() {
+		for _, f := range r.files {
+			f.close()
+		}
+	}()
+	for {
+		select {
+		case sr := <-r.records:
+			r.write(sr)
+		case <-r.stop:
+			for {
+				select {
+				case sr := <-r.records:
+					r.write(sr)
+				default:
+					return
+				}
+			}
+		}
+		// flush once the burst is written
+		if len(r.records) == 0 {
+			for _, f := range r.files {
+				f.flush()
+			}
+		}
+	}
+}
+
+func (r *Recorder) write(sr scopedRecord) {
+	f, ok := r.files[sr.scope]
+	if !ok {
+		f = &recordFile{path: filepath.Join(r.config.Dir, recordFileName(sr.scope)), maxFiles: r.config.MaxFiles}
+		r.files[sr.scope] = f
+	}
+	line, err := json.Marshal(sr.record)
+	if err == nil {
+		err = f.write(append(line, '\n'), r.config.MaxFileSize)
+	}
+	if err != nil {
+		r.config.Logger.Log(LevelWarn, "record failed", F("app", sr.scope.App), F("address", sr.scope.Address), F("error", err))
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// recordFileName names the file of scope. Sanitized names get a hash of the
+// scope after a "~", which unsafeFileChars never lets through, so different
+// scopes never share a file.
+func recordFileName(scope recordScope) string {
+	name := unsafeFileChars.ReplaceAllString(scope.App, "_")
+	if scope.Address != "" {
+		name += "@" + unsafeFileChars.ReplaceAllString(scope.Address, "_")
+	}
+	if name != scope.App && name != scope.App+"@"+scope.Address {
+		sum := sha256.Sum256([]byte(scope.App + "\x00" + scope.Address))
+		name += "~" + hex.EncodeToString(sum[:4])
+	}
+	return name + ".jsonl"
+}
+
+type recordFile struct {
+	path     string
+	maxFiles int
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+}
+
+func (rf *recordFile) write(line []byte, maxSize int64) error {
+	if rf.f != nil && rf.size+int64(len(line)) > maxSize {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	if rf.f == nil {
+		f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrap(err, "open record file")
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return errors.Wrap(err, "stat record file")
+		}
+		rf.f, rf.w, rf.size = f, bufio.NewWriter(f), info.Size()
+	}
+	n, err := rf.w.Write(line)
+	rf.size += int64(n)
+	return err
+}
+
+// rotate renames the current file with a "+" and a timestamp suffix and
+// removes the oldest rotated files beyond maxFiles.
+func (rf *recordFile) rotate() error {
+	rf.close()
+	dir, name := filepath.Split(rf.path)
+	ext := filepath.Ext(name)
+	base := name[:len(name)-len(ext)]
+	rotated := base + "+" + strconv.FormatInt(time.Now().UnixNano(), 10) + ext
+	if err := os.Rename(rf.path, filepath.Join(dir, rotated)); err != nil {
+		return errors.Wrap(err, "rotate record file")
+	}
+	infos, err := ioutil.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return errors.Wrap(err, "list record files")
+	}
+	var old []string
+	for _, info := range infos {
+		if isRotated(info.Name(), base, ext) {
+			old = append(old, info.Name())
+		}
+	}
+	sort.Strings(old)
+	for len(old) > rf.maxFiles-1 {
+		os.Remove(filepath.Join(dir, old[0]))
+		old = old[1:]
+	}
+	return nil
+}
+
+// isRotated reports whether name is a rotated file of base, only digits may
+// follow its "+".
+func isRotated(name, base, ext string) bool {
+	if !strings.HasPrefix(name, base+"+") || !strings.HasSuffix(name, ext) {
+		return false
+	}
+	stamp := name[len(base)+1 : len(name)-len(ext)]
+	if stamp == "" {
+		return false
+	}
+	for _, c := range stamp {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (rf *recordFile) flush() {
+	if rf.w != nil {
+		rf.w.Flush()
+	}
+}
+
+func (rf *recordFile) close() {
+	if rf.f == nil {
+		return
+	}
+	rf.w.Flush()
+	rf.f.Close()
+	rf.f, rf.w = nil, nil
+}
+
+// ServeHTTP lists the recorded scopes, a POST with app, optional address and
+// enable=true|false changes them.
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		app := req.FormValue("app")
+		enable, err := strconv.ParseBool(req.FormValue("enable"))
+		if app == "" || err != nil {
+			http.Error(w, "app and enable=true|false are required", http.StatusBadRequest)
+			return
+		}
+		if enable {
+			r.Enable(app, req.FormValue("address"))
+		} else {
+			r.Disable(app, req.FormValue("address"))
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.mu.RLock()
+	scopes := make([]recordScope, 0, len(r.scopes))
+	for scope := range r.scopes {
+		scopes = append(scopes, scope)
+	}
+	r.mu.RUnlock()
+	sort.Slice(scopes, func(i, j int) bool {
+		if scopes[i].App != scopes[j].App {
+			return scopes[i].App < scopes[j].App
+		}
+		return scopes[i].Address < scopes[j].Address
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"scopes": scopes, "dropped": r.Dropped()})
+}
@@ -0,0 +1,263 @@
+package signalsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRedact(t *testing.T) {
+	sdp := `{"sdp":"v=0\r\no=- 4611 2 IN IP4 127.0.0.1\r\nc=IN IP4 203.0.113.5\r\na=ice-ufrag:F7gI\r\na=ice-pwd:x9cml/YzichV2+XlhiMu8g\r\na=fingerprint:sha-256 D1:2C:BE:AD:EE\r\na=rtpmap:111 opus/48000/2\r\n","type":"offer"}`
+	got := Redact(sdp)
+	for _, secret := range []string{"127.0.0.1", "203.0.113.5", "F7gI", "x9cml", "D1:2C"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("expected %s to be redacted got: %s", secret, got)
+		}
+	}
+	if !strings.Contains(got, "a=rtpmap:111 opus/48000/2") {
+		t.Errorf("expected codecs to be kept got: %s", got)
+	}
+
+	candidate := `{"candidate":"candidate:842163049 1 udp 1677729535 2001:db8::1 54321 typ srflx raddr 192.168.1.2 rport 54321 generation 0 ufrag F7gI","sdpMid":"0","usernameFragment":"F7gI"}`
+	got = Redact(candidate)
+	for _, secret := range []string{"2001:db8::1", "192.168.1.2", "F7gI"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("expected %s to be redacted got: %s", secret, got)
+		}
+	}
+	if want, got := "at 12:34:56", Redact("at 12:34:56"); want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+}
+
+func TestRecordEvent(t *testing.T) {
+	_, peers := newTestRoom(1)
+	text := "hello"
+	events := []*NetworkEvent{
+		NewNetworkEvent(NetEventTypeServerInitialized, INVALIDConnectionId, &NetEventData{Type: NetEventDataTypeUTF16String, StringData: &text}),
+		NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(3), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte("offer")}),
+		NewNetworkEvent(NetEventTypeUnreliableMessageReceived, NewConnectionId(3), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte{0xff, 0x00}}),
+		NewNetworkEvent(NetEventTypeDisconnected, NewConnectionId(3), &NetEventData{Type: NetEventDataTypeNull}),
+	}
+	for _, evt := range events {
+		r := newRecord(peers[0], "room", DirectionIn, evt, true)
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Record
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decoded.Event()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := evt.ToByteArray(), got.ToByteArray(); !bytes.Equal(want, got) {
+			t.Errorf("expected %v got: %v", want, got)
+		}
+	}
+}
+
+func TestRecordUTF16(t *testing.T) {
+	_, peers := newTestRoom(1)
+	payloads := []string{
+		`{"candidate":"candidate:842163049 1 udp 1677729535 203.0.113.5 54321 typ srflx raddr 192.168.1.2 rport 54321 ufrag F7gI","usernameFragment":"F7gI"}`,
+		`{"sdp":"v=0\r\nc=IN IP4 203.0.113.5\r\na=ice-ufrag:F7gI\r\na=ice-pwd:x9cml/YzichV2+XlhiMu8g\r\na=fingerprint:sha-256 D1:2C:BE:AD:EE\r\n","type":"offer"}`,
+	}
+	for _, payload := range payloads {
+		evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(3), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: encodeUTF16(payload)})
+		r := newRecord(peers[0], "room", DirectionIn, evt, true)
+		if !r.UTF16 || r.Base64 {
+			t.Fatalf("expected the payload to be recorded as utf16 text got: %+v", r)
+		}
+		for _, secret := range []string{"203.0.113.5", "192.168.1.2", "F7gI", "x9cml", "D1:2C"} {
+			if strings.Contains(*r.Data, secret) {
+				t.Errorf("expected %s to be redacted got: %s", secret, *r.Data)
+			}
+		}
+
+		r = newRecord(peers[0], "room", DirectionIn, evt, false)
+		if want, got := payload, *r.Data; want != got {
+			t.Errorf("expected %s got: %s", want, got)
+		}
+		got, err := r.Event()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := evt.ToByteArray(), got.ToByteArray(); !bytes.Equal(want, got) {
+			t.Errorf("expected %v got: %v", want, got)
+		}
+	}
+}
+
+func TestRecordFileName(t *testing.T) {
+	if want, got := "Test@room.jsonl", recordFileName(recordScope{"Test", "room"}); want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	names := make(map[string]recordScope)
+	for _, scope := range []recordScope{{"Test", "a b"}, {"Test", "a_b"}, {"Test", "a/b"}, {"Test@a", "b"}, {"Test", "a@b"}} {
+		name := recordFileName(scope)
+		if other, ok := names[name]; ok {
+			t.Errorf("expected %v and %v to have different files got: %s", scope, other, name)
+		}
+		names[name] = scope
+	}
+}
+
+func TestRecorderRotateScopes(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	others := []string{"Test@room-2.jsonl", "Test@room-2+1.jsonl", "Test-foo.jsonl", "Test-foo+1.jsonl", "Test@room+old.jsonl"}
+	for _, name := range others {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{filepath.Join(dir, "Test@room.jsonl"), filepath.Join(dir, "Test.jsonl")} {
+		rf := &recordFile{path: path, maxFiles: 2}
+		for i := 0; i < 3; i++ {
+			if err := rf.write([]byte("{}\n"), 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rf.close()
+	}
+	for _, name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be kept got: %v", name, err)
+		}
+	}
+	rotated, _ := filepath.Glob(filepath.Join(dir, "Test@room+*.jsonl"))
+	// one rotated file is kept besides the one without a timestamp
+	if want, got := 2, len(rotated); want != got {
+		t.Errorf("expected %d files got: %v", want, rotated)
+	}
+}
+
+func readRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "awsignal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRecorder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec, err := NewRecorder(RecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Enable("Test", "room")
+	_, url, closeServer := newTestServer(t, &ServerConfig{Recorder: rec}, &AppConfig{Path: "/", AppName: "Test"})
+
+	other := dialTestClient(t, url)
+	defer other.conn.Close()
+	other.send(t, NetEventTypeServerInitialized, -1, "other")
+	other.expect(t, NetEventTypeServerInitialized)
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room")
+	listener.expect(t, NetEventTypeServerInitialized)
+	connector := dialTestClient(t, url)
+	defer connector.conn.Close()
+	connector.send(t, NetEventTypeNewConnection, 1, "room")
+	connector.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+	candidate := []byte(`{"candidate":"candidate:1 1 udp 2122260223 10.0.0.7 50000 typ host"}`)
+	evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(1), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: candidate})
+	if err := connector.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+		t.Fatal(err)
+	}
+	listener.expect(t, NetEventTypeReliableMessageReceived)
+
+	closeServer()
+	rec.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if want, got := 1, len(files); want != got {
+		t.Fatalf("expected %d file got: %v", want, files)
+	}
+	records := readRecords(t, filepath.Join(dir, "Test@room.jsonl"))
+	var types []string
+	for _, r := range records {
+		types = append(types, r.Direction+" "+r.Type)
+		if r.Data != nil && strings.Contains(*r.Data, "10.0.0.7") {
+			t.Errorf("expected the candidate to be redacted got: %s", *r.Data)
+		}
+	}
+	want := []string{
+		"in ServerInitialized", "out ServerInitialized",
+		"in NewConnection", "out NewConnection", "out NewConnection",
+		"in ReliableMessageReceived", "out ReliableMessageReceived",
+	}
+	if got := types; len(got) < len(want) {
+		t.Fatalf("expected at least %v got: %v", want, got)
+	}
+	// the two outgoing NewConnection events are written by different peers
+	// and may be recorded in either order.
+	for i, w := range want {
+		if types[i] != w {
+			t.Errorf("expected %v got: %v", want, types)
+			break
+		}
+	}
+}
+
+func TestRecorderRotate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec, err := NewRecorder(RecorderConfig{Dir: dir, MaxFileSize: 512, MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Enable("Test", "")
+	_, peers := newTestRoom(1)
+	for i := 0; i < 50; i++ {
+		rec.record(peers[0], DirectionOut, NewNetworkEvent(NetEventTypeDisconnected, NewConnectionId(int16(i)), &NetEventData{Type: NetEventDataTypeNull}))
+	}
+	rec.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "Test*.jsonl"))
+	if want, got := 3, len(files); want != got {
+		t.Fatalf("expected %d files got: %v", want, files)
+	}
+	for _, f := range files {
+		info, _ := os.Stat(f)
+		if info.Size() > 512 {
+			t.Errorf("expected %s to be rotated at 512 bytes got: %d", f, info.Size())
+		}
+	}
+	records := readRecords(t, filepath.Join(dir, "Test.jsonl"))
+	if want, got := int16(49), records[len(records)-1].ConnectionId; want != got {
+		t.Errorf("expected the last record in the current file got: %d", got)
+	}
+}
@@ -0,0 +1,224 @@
+package signalsrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+var replaySettle = 50 * time.Millisecond
+
+type ReplayConfig struct {
+	// URL is the websocket url of the app the session is replayed against.
+	URL string
+	// Speed scales the recorded timing, 1 keeps it and 0 sends as fast as
+	// possible. Either way a peer only sends once it received the events it
+	// had received at that point of the recording.
+	Speed float64
+	// Timeout bounds every wait for expected events, default 5s.
+	Timeout time.Duration
+}
+
+// ReplayDiff is a difference between the recorded and the observed outbound
+// events of a peer. A missing or unexpected event has an empty counterpart.
+type ReplayDiff struct {
+	Peer     PeerId `json:"peer"`
+	Index    int    `json:"index"`
+	Expected string `json:"expected,omitempty"`
+	Observed string `json:"observed,omitempty"`
+}
+
+type ReplayResult struct {
+	Peers    int          `json:"peers"`
+	Sent     int          `json:"sent"`
+	Received int          `json:"received"`
+	Diffs    []ReplayDiff `json:"diffs"`
+}
+
+// ReadRecords reads a JSONL recording.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 2*maxMessageSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		records = append(records, rec)
+	}
+	return records, errors.Wrap(scanner.Err(), "read records")
+}
+
+// describe renders the parts of a record a replay is compared by. Payloads
+// are redacted, so recordings with and without redaction compare equal.
+func (r *Record) describe() string {
+	s := fmt.Sprintf("%s id=%d %s", r.Type, r.ConnectionId, r.DataType)
+	if r.Data != nil {
+		data := *r.Data
+		if !r.Base64 {
+			data = Redact(data)
+		}
+		s += " " + data
+	}
+	return s
+}
+
+// replayClient is the virtual client of one recorded peer.
+type replayClient struct {
+	peer     PeerId
+	conn     *websocket.Conn
+	mu       sync.Mutex
+	observed []string
+	changed  chan struct{}
+	expected []string
+}
+
+func (c *replayClient) readLoop() {
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			c.mu.Lock()
+			close(c.changed)
+			c.changed = nil
+			c.mu.Unlock()
+			return
+		}
+		evt, err := FromByteArray(msg)
+		if err != nil {
+			continue
+		}
+		var rec Record
+		rec.setEvent(evt, false)
+		c.mu.Lock()
+		c.observed = append(c.observed, rec.describe())
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.mu.Unlock()
+	}
+}
+
+// waitFor waits until the client received n events or the connection ended.
+func (c *replayClient) waitFor(ctx context.Context, n int) {
+	for {
+		c.mu.Lock()
+		got, changed := len(c.observed), c.changed
+		c.mu.Unlock()
+		if got >= n || changed == nil {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *replayClient) diff() []ReplayDiff {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var diffs []ReplayDiff
+	for i := 0; i < len(c.expected) || i < len(c.observed); i++ {
+		d := ReplayDiff{Peer: c.peer, Index: i}
+		if i < len(c.expected) {
+			d.Expected = c.expected[i]
+		}
+		if i < len(c.observed) {
+			d.Observed = c.observed[i]
+		}
+		if d.Expected != d.Observed {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// Replay connects a virtual client per recorded peer, sends the recorded
+// inbound events and compares the outbound events each client receives with
+// the recording.
+func Replay(ctx context.Context, records []Record, config ReplayConfig) (*ReplayResult, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	result := &ReplayResult{}
+	clients := make(map[PeerId]*replayClient)
+	defer func() {
+		for _, c := range clients {
+			c.conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	for _, rec := range records {
+		c, ok := clients[rec.Peer]
+		if !ok {
+			conn, _, err := websocket.DefaultDialer.DialContext(ctx, config.URL, nil)
+			if err != nil {
+				return nil, errors.Wrapf(err, "dial for peer %d", rec.Peer)
+			}
+			c = &replayClient{peer: rec.Peer, conn: conn, changed: make(chan struct{})}
+			clients[rec.Peer] = c
+			go c.readLoop()
+		}
+		if rec.Direction == DirectionOut {
+			c.expected = append(c.expected, rec.describe())
+			continue
+		}
+
+		if config.Speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(records[0].Time)) / config.Speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		wait, cancel := context.WithTimeout(ctx, config.Timeout)
+		c.waitFor(wait, len(c.expected))
+		cancel()
+
+		evt, err := rec.Event()
+		if err != nil {
+			return nil, errors.Wrapf(err, "peer %d", rec.Peer)
+		}
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+			return nil, errors.Wrapf(err, "send for peer %d", rec.Peer)
+		}
+		result.Sent++
+	}
+
+	ids := make([]PeerId, 0, len(clients))
+	for id, c := range clients {
+		wait, cancel := context.WithTimeout(ctx, config.Timeout)
+		c.waitFor(wait, len(c.expected))
+		cancel()
+		ids = append(ids, id)
+	}
+	// give the server a moment to send events the recording does not have
+	time.Sleep(replaySettle)
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		c := clients[id]
+		c.mu.Lock()
+		result.Received += len(c.observed)
+		c.mu.Unlock()
+		result.Diffs = append(result.Diffs, c.diff()...)
+	}
+	result.Peers = len(clients)
+	return result, ctx.Err()
+}
@@ -0,0 +1,113 @@
+package signalsrv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordSession records a listener, a connector exchanging two messages and
+// the connector disconnecting.
+func recordSession(t *testing.T) []Record {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	rec, err := NewRecorder(RecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Enable("Test", "")
+	_, url, closeServer := newTestServer(t, &ServerConfig{Recorder: rec}, &AppConfig{Path: "/", AppName: "Test"})
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room")
+	listener.expect(t, NetEventTypeServerInitialized)
+	connector := dialTestClient(t, url)
+	defer connector.conn.Close()
+	connector.send(t, NetEventTypeNewConnection, 1, "room")
+	connector.expect(t, NetEventTypeNewConnection)
+	id := listener.expect(t, NetEventTypeNewConnection).ConnectionId.ID
+
+	send := func(c *testClient, id int16, payload string) {
+		evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(id), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte(payload)})
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(connector, 1, `{"type":"offer","sdp":"c=IN IP4 10.0.0.1"}`)
+	listener.expect(t, NetEventTypeReliableMessageReceived)
+	time.Sleep(20 * time.Millisecond)
+	send(listener, id, `{"type":"answer"}`)
+	connector.expect(t, NetEventTypeReliableMessageReceived)
+	connector.send(t, NetEventTypeDisconnected, 1, "")
+	listener.expect(t, NetEventTypeDisconnected)
+
+	connector.conn.Close()
+	listener.conn.Close()
+	closeServer()
+	rec.Close()
+
+	f, err := os.Open(filepath.Join(dir, "Test.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := ReadRecords(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestReplay(t *testing.T) {
+	records := recordSession(t)
+	for name, speed := range map[string]float64{"fast": 0, "timed": 4} {
+		t.Run(name, func(t *testing.T) {
+			_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+			defer closeServer()
+			result, err := Replay(context.Background(), append([]Record(nil), records...), ReplayConfig{URL: url, Speed: speed, Timeout: time.Second})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := 2, result.Peers; want != got {
+				t.Errorf("expected %d peers got: %d", want, got)
+			}
+			if want, got := 5, result.Sent; want != got {
+				t.Errorf("expected %d sent events got: %d", want, got)
+			}
+			if len(result.Diffs) > 0 {
+				t.Errorf("expected no diffs got: %+v", result.Diffs)
+			}
+		})
+	}
+}
+
+func TestReplayDiff(t *testing.T) {
+	records := recordSession(t)
+	// a listener that can't take the address anymore fails differently
+	_, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+	squatter := dialTestClient(t, url)
+	defer squatter.conn.Close()
+	squatter.send(t, NetEventTypeServerInitialized, -1, "room")
+	squatter.expect(t, NetEventTypeServerInitialized)
+
+	result, err := Replay(context.Background(), records, ReplayConfig{URL: url, Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Diffs) == 0 {
+		t.Fatal("expected diffs")
+	}
+	first := result.Diffs[0]
+	if want, got := "ServerInitialized id=-1 UTF16String room", first.Expected; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if want, got := "ServerInitFailed id=-1 UTF16String room", first.Observed; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+}
@@ -0,0 +1,138 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Smoothing factors of the RTT estimator, as in RFC 6298.
+const (
+	rttAlpha = 0.125
+	rttBeta  = 0.25
+)
+
+// RTTStats are the keepalive round trip times of a peer.
+type RTTStats struct {
+	LastMs      float64 `json:"last_ms"`
+	SmoothedMs  float64 `json:"smoothed_ms"`
+	JitterMs    float64 `json:"jitter_ms"`
+	Samples     uint64  `json:"samples"`
+	MissedPongs uint64  `json:"missed_pongs"`
+}
+
+// rttTracker times the round trip of each ping. Only one ping is outstanding
+// at a time, a ping sent before the previous one was answered counts as a
+// missed pong.
+type rttTracker struct {
+	mu       sync.Mutex
+	pingSent time.Time
+	last     time.Duration
+	smoothed time.Duration
+	jitter   time.Duration
+	samples  uint64
+	missed   uint64
+}
+
+// sent is called right before a ping is written and reports whether the
+// previous ping is still unanswered.
+func (r *rttTracker) sent(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	missed := !r.pingSent.IsZero()
+	if missed {
+		r.missed++
+	}
+	r.pingSent = now
+	return missed
+}
+
+// received is called for every pong, unsolicited pongs don't yield a sample.
+func (r *rttTracker) received(now time.Time) (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pingSent.IsZero() {
+		return 0, false
+	}
+	rtt := now.Sub(r.pingSent)
+	r.pingSent = time.Time{}
+	if r.samples == 0 {
+		r.smoothed = rtt
+		r.jitter = rtt / 2
+	} else {
+		diff := r.smoothed - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		r.jitter += time.Duration(rttBeta * float64(diff-r.jitter))
+		r.smoothed += time.Duration(rttAlpha * float64(rtt-r.smoothed))
+	}
+	r.last = rtt
+	r.samples++
+	return rtt, true
+}
+
+func (r *rttTracker) stats() RTTStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RTTStats{
+		LastMs:      milliseconds(r.last),
+		SmoothedMs:  milliseconds(r.smoothed),
+		JitterMs:    milliseconds(r.jitter),
+		Samples:     r.samples,
+		MissedPongs: r.missed,
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pingSent must be called before every keepalive ping of the peer.
+func (sp *SignalingPeer) pingSent() {
+	if sp.rtt.sent(time.Now()) {
+		sp.connectionPool.metrics.countMissedPong(sp.app())
+	}
+}
+
+func (sp *SignalingPeer) pong() {
+	now := time.Now()
+	atomic.StoreInt64(&sp.lastPong, now.UnixNano())
+	rtt, ok := sp.rtt.received(now)
+	if !ok {
+		return
+	}
+	sp.connectionPool.metrics.observeRTT(sp.app(), rtt)
+	if sp.connectionPool.appConfig.ShareRTT && sp.connectionPool.hasAddressSharing() {
+		sp.shareRTT()
+	}
+}
+
+// rttNotice is the payload of the Log event that tells the peers of a shared
+// room the RTT of the peer behind a connection id.
+type rttNotice struct {
+	RTT RTTStats `json:"rtt"`
+}
+
+// shareRTT sends the RTT stats of the peer to every peer it is linked with,
+// each with the connection id the receiver knows the peer by.
+func (sp *SignalingPeer) shareRTT() {
+	b, err := json.Marshal(rttNotice{RTT: sp.rtt.stats()})
+	if err != nil {
+		return
+	}
+	text := string(b)
+	pool := sp.connectionPool
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if sp.state != SignalingConnectionStateConnected {
+		return
+	}
+	for _, peer := range linkedPeers(sp) {
+		for _, id := range peer.connectionIds[sp] {
+			peer.sendToClient(NewNetworkEvent(NetEventTypeLog, NewConnectionId(id),
+				&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &text}))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package signalsrv
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRTTTracker(t *testing.T) {
+	var r rttTracker
+	now := time.Now()
+	if _, ok := r.received(now); ok {
+		t.Error("expected an unsolicited pong to be ignored")
+	}
+	for i, rtt := range []time.Duration{40, 60, 40, 60} {
+		if r.sent(now) {
+			t.Errorf("expected no missed pong at ping %d", i)
+		}
+		now = now.Add(rtt * time.Millisecond)
+		if got, _ := r.received(now); got != rtt*time.Millisecond {
+			t.Errorf("expected %v got: %v", rtt*time.Millisecond, got)
+		}
+	}
+	r.sent(now)
+	if !r.sent(now.Add(time.Second)) {
+		t.Error("expected an unanswered ping to count as missed")
+	}
+
+	stats := r.stats()
+	if want, got := uint64(4), stats.Samples; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := uint64(1), stats.MissedPongs; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+	if want, got := 60.0, stats.LastMs; want != got {
+		t.Errorf("expected %v got: %v", want, got)
+	}
+	if stats.SmoothedMs < 40 || stats.SmoothedMs > 60 || stats.JitterMs <= 0 {
+		t.Errorf("expected smoothed stats got: %+v", stats)
+	}
+}
+
+func TestRTT(t *testing.T) {
+	defer func(ping time.Duration) { pingPeriod = ping }(pingPeriod)
+	pingPeriod = 20 * time.Millisecond
+
+	for mode, config := range testModes {
+		t.Run(mode, func(t *testing.T) {
+			wns, url, closeServer := newTestServer(t, config, &AppConfig{Path: "/", AppName: "Test", AddressSharing: true, ShareRTT: true})
+			defer closeServer()
+
+			a := dialTestClient(t, url)
+			defer a.conn.Close()
+			a.send(t, NetEventTypeServerInitialized, -1, "room")
+			a.expect(t, NetEventTypeServerInitialized)
+			b := dialTestClient(t, url)
+			defer b.conn.Close()
+			b.send(t, NetEventTypeServerInitialized, -1, "room")
+			b.expect(t, NetEventTypeServerInitialized)
+			link := b.expect(t, NetEventTypeNewConnection)
+			a.expect(t, NetEventTypeNewConnection)
+
+			evt := b.expect(t, NetEventTypeLog)
+			if want, got := link.ConnectionId.ID, evt.ConnectionId.ID; want != got {
+				t.Errorf("expected %d got: %d", want, got)
+			}
+			var notice rttNotice
+			if err := json.Unmarshal([]byte(*evt.GetInfo().StringData), &notice); err != nil {
+				t.Fatal(err)
+			}
+			if notice.RTT.Samples == 0 || notice.RTT.LastMs <= 0 {
+				t.Errorf("expected an rtt sample got: %+v", notice.RTT)
+			}
+			a.expect(t, NetEventTypeLog)
+
+			for _, info := range testPeers(wns, "Test", "") {
+				if info.RTT.Samples == 0 {
+					t.Errorf("expected rtt stats for peer %d got: %+v", info.ID, info.RTT)
+				}
+			}
+			rec := httptest.NewRecorder()
+			wns.Metrics().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			if want := `awsignal_ping_rtt_seconds_count{app="Test"}`; !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("expected metrics to contain %q got:\n%s", want, rec.Body.String())
+			}
+
+			atomic.StoreInt32(&b.mute, 1)
+			deadline := time.Now().Add(2 * time.Second)
+			for time.Now().Before(deadline) {
+				var missed uint64
+				for _, info := range testPeers(wns, "Test", "") {
+					missed += info.RTT.MissedPongs
+				}
+				if missed > 0 {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Error("expected a missed pong of the muted client")
+		})
+	}
+}
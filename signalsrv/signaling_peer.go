@@ -1,11 +1,16 @@
 package signalsrv
 
 import (
+	"bufio"
+	"context"
 	"fmt"
-	"log"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -16,62 +21,379 @@ const (
 	SignalingConnectionStateDisconnected
 )
 
+func stateName(state int) string {
+	switch state {
+	case SignalingConnectionStateUninitialized:
+		return "uninitialized"
+	case SignalingConnectionStateConnecting:
+		return "connecting"
+	case SignalingConnectionStateConnected:
+		return "connected"
+	case SignalingConnectionStateDisconnection:
+		return "disconnecting"
+	case SignalingConnectionStateDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+type DisconnectReason string
+
+const (
+	DisconnectClientClosed   DisconnectReason = "client_closed"
+	DisconnectPingTimeout    DisconnectReason = "ping_timeout"
+	DisconnectReadError      DisconnectReason = "read_error"
+	DisconnectWriteError     DisconnectReason = "write_error"
+	DisconnectProtocolError  DisconnectReason = "protocol_error"
+	DisconnectQueueFull      DisconnectReason = "queue_full"
+	DisconnectServerClosed   DisconnectReason = "server_closed"
+	DisconnectServerShutdown DisconnectReason = "server_shutdown"
+	DisconnectKicked         DisconnectReason = "kicked"
+	DisconnectTokenExpired   DisconnectReason = "token_expired"
+	DisconnectRateLimited    DisconnectReason = "rate_limited"
+)
+
+// closeCode is the close frame sent to the client, 0 if the connection is
+// already unusable.
+func (r DisconnectReason) closeCode() int {
+	switch r {
+	case DisconnectProtocolError:
+		return websocket.CloseProtocolError
+	case DisconnectQueueFull:
+		return websocket.CloseTryAgainLater
+	case DisconnectServerClosed:
+		return websocket.CloseNormalClosure
+	case DisconnectServerShutdown:
+		return websocket.CloseGoingAway
+	case DisconnectKicked, DisconnectTokenExpired, DisconnectRateLimited:
+		return websocket.ClosePolicyViolation
+	default:
+		return 0
+	}
+}
+
+// PeerId identifies a peer for the lifetime of the process. Unlike the
+// remote address it is never shared or reused by another connection.
+type PeerId uint64
+
+var lastPeerId uint64
+
+func nextPeerId() PeerId {
+	return PeerId(atomic.AddUint64(&lastPeerId, 1))
+}
+
+type queuedEvent struct {
+	evt    *NetworkEvent
+	queued time.Time
+}
+
 type SignalingPeer struct {
+	id                       PeerId
 	state                    int
 	connections              map[int16]*SignalingPeer
+	connectionIds            map[*SignalingPeer][]int16
 	nextIncomingConnectionId *ConnectionId
 	connInfo                 string
 	connectionPool           *PeerPool
 	socket                   *websocket.Conn
 	isAlive                  bool
 	serverAddress            *string
-	send                     chan *NetworkEvent
+	listening                atomic.Value
+	joined                   atomic.Value
+	send                     chan queuedEvent
+	reader                   *bufio.Reader
+	lowMemory                bool
+	polled                   bool
+	pollFd                   int
+	writing                  int32
+	overflowed               int32
+	lastPong                 int64
+	rtt                      rttTracker
+	ctx                      context.Context
+	cancel                   context.CancelFunc
+	closeOnce                sync.Once
+	reason                   DisconnectReason
+	refs                     int32
+	done                     chan struct{}
+	connectedAt              time.Time
+	trace                    SpanContext
+	claims                   *Claims
+	expiry                   *time.Timer
+	limiter                  *peerLimiter
+	ip                       string
+	ipLimit                  *ipLimiter
+	knocks                   map[int16]*knock
+	knocking                 map[int16]*knock
 }
 
-func NewSignalingPeer(pool *PeerPool, conn *websocket.Conn) *SignalingPeer {
-	sp := &SignalingPeer{
+func NewSignalingPeer(pool *PeerPool, conn *websocket.Conn, reader *bufio.Reader) *SignalingPeer {
+	ctx, cancel := context.WithCancel(pool.server.ctx)
+	return &SignalingPeer{
+		id:                       nextPeerId(),
 		state:                    SignalingConnectionStateConnecting,
 		connections:              make(map[int16]*SignalingPeer),
+		connectionIds:            make(map[*SignalingPeer][]int16),
 		nextIncomingConnectionId: NewConnectionId(16384),
 		connInfo:                 conn.RemoteAddr().String(),
 		connectionPool:           pool,
 		socket:                   conn,
 		isAlive:                  true,
 		serverAddress:            nil,
-		send:                     make(chan *NetworkEvent, 256),
+		send:                     make(chan queuedEvent, 256),
+		reader:                   reader,
+		lowMemory:                pool.server.pinger != nil,
+		lastPong:                 time.Now().UnixNano(),
+		ctx:                      ctx,
+		cancel:                   cancel,
+		refs:                     1,
+		done:                     make(chan struct{}),
+		connectedAt:              time.Now(),
+		limiter:                  newPeerLimiter(pool.appConfig.Limits),
 	}
-	sp.run()
-	log.Printf("[%s] connected on %s", sp.connInfo, sp.socket.LocalAddr().String())
-	sp.state = SignalingConnectionStateConnected
+}
+
+func (sp *SignalingPeer) ID() PeerId {
+	return sp.id
+}
+
+// ConnInfo is the remote address of the peer, for display only.
+func (sp *SignalingPeer) ConnInfo() string {
+	return sp.connInfo
+}
+
+// Claims are the verified token claims of the peer, nil if the app doesn't
+// authenticate or the peer came without a token.
+func (sp *SignalingPeer) Claims() *Claims {
+	return sp.claims
+}
+
+func (sp *SignalingPeer) app() string {
+	return sp.connectionPool.appConfig.AppName
+}
 
-	return sp
+// address is the address the peer listens on, it may be read without the
+// pool lock.
+func (sp *SignalingPeer) address() string {
+	address, _ := sp.listening.Load().(string)
+	return address
+}
+
+// eventAddress is the address an event belongs to: the address named by the
+// event without its extension, else the address the peer listens on or last
+// connected to.
+func (sp *SignalingPeer) eventAddress(evt *NetworkEvent) string {
+	if info := evt.GetInfo(); info != nil && info.StringData != nil &&
+		(evt.Type == NetEventTypeNewConnection || evt.Type == NetEventTypeServerInitialized) {
+		address, _ := splitAddress(*info.StringData)
+		return address
+	}
+	return sp.scopeAddress()
+}
+
+// scopeAddress is the address the peer listens on or last connected to.
+func (sp *SignalingPeer) scopeAddress() string {
+	if address := sp.address(); address != "" {
+		return address
+	}
+	address, _ := sp.joined.Load().(string)
+	return address
+}
+
+// publish sends a routing event of the peer to the admin event taps.
+func (sp *SignalingPeer) publish(evt TapEvent, payload *NetworkEvent) {
+	evt.App, evt.Peer = sp.app(), sp.id
+	sp.taps().publish(evt, payload)
+}
+
+func (sp *SignalingPeer) log(level Level, msg string, fields ...Field) {
+	sp.logScoped(level, sp.address(), msg, fields...)
+}
+
+func (sp *SignalingPeer) logScoped(level Level, address string, msg string, fields ...Field) {
+	server := sp.connectionPool.server
+	if server == nil || !server.verbosity.Enabled(level, sp.app(), address) {
+		return
+	}
+	base := []Field{F("app", sp.app()), F("peer", sp.id), F("remote", sp.connInfo)}
+	if sp.claims != nil {
+		base = append(base, F("user", sp.claims.Subject))
+		if sp.claims.Tenant != "" {
+			base = append(base, F("tenant", sp.claims.Tenant))
+		}
+	}
+	if address != "" {
+		base = append(base, F("address", address))
+	}
+	server.logger.Log(level, msg, append(base, fields...)...)
+}
+
+// logEvent logs an event at debug level. Payloads are only written if the
+// verbosity asks for them, they may contain SDP and ICE candidates.
+func (sp *SignalingPeer) logEvent(direction string, evt *NetworkEvent, size int) {
+	address := sp.eventAddress(evt)
+	server := sp.connectionPool.server
+	if server == nil || !server.verbosity.Enabled(LevelDebug, sp.app(), address) {
+		return
+	}
+	fields := []Field{
+		F("direction", direction),
+		F("type", eventTypeLabel(evt.Type)),
+		F("connection_id", evt.ConnectionId.ID),
+		F("size", size),
+	}
+	if server.verbosity.Payloads() {
+		fields = append(fields, F("payload", maskAccess(evt).String()))
+	}
+	sp.logScoped(LevelDebug, address, "event", fields...)
+}
+
+func (sp *SignalingPeer) recordEvent(direction string, evt *NetworkEvent) {
+	if server := sp.connectionPool.server; server != nil {
+		server.recorder.record(sp, direction, evt)
+	}
 }
 
 func (sp *SignalingPeer) GetName() string {
-	return fmt.Sprintf("[%s]", sp.connInfo)
+	return fmt.Sprintf("[#%d %s]", sp.id, sp.connInfo)
+}
+
+// Done is closed once the peer has left its pool and all of its goroutines
+// have returned.
+func (sp *SignalingPeer) Done() <-chan struct{} {
+	return sp.done
 }
 
 func (sp *SignalingPeer) run() {
-	go sp.readPump()
-	go sp.writePump()
+	if !sp.lowMemory {
+		sp.startPump(sp.readPump)
+		sp.startPump(sp.writePump)
+		return
+	}
+
+	// the pinger reads polled, so the peer is only added once it is settled.
+	server := sp.connectionPool.server
+	if server.poller != nil && sp.reader != nil {
+		sp.socket.SetPongHandler(func(string) error { sp.pong(); return nil })
+		sp.polled = true
+		err := server.poller.add(sp)
+		if err == nil {
+			server.pinger.add(sp)
+			return
+		}
+		sp.polled = false
+		sp.log(LevelWarn, "netpoll registration failed", F("error", err))
+	}
+	server.pinger.add(sp)
+	sp.startPump(sp.readPump)
+}
+
+// startPump runs f in a goroutine that holds a reference to the peer until it
+// returns. It must only be called while the peer itself still holds its own
+// reference, i.e. before Close has finished.
+func (sp *SignalingPeer) startPump(f func()) {
+	atomic.AddInt32(&sp.refs, 1)
+	go func() {
+		defer sp.release()
+		f()
+	}()
+}
+
+// release drops a reference, the last one discards whatever is still queued
+// and closes done.
+func (sp *SignalingPeer) release() {
+	if atomic.AddInt32(&sp.refs, -1) != 0 {
+		return
+	}
+	dropped := 0
+	for len(sp.send) > 0 {
+		<-sp.send
+		dropped++
+	}
+	if dropped > 0 {
+		sp.log(LevelInfo, "discarded queued events", F("count", dropped))
+		sp.connectionPool.metrics.countDrop(sp.app(), DropDiscardedOnClose, dropped)
+	}
+	close(sp.done)
 }
 
+// sendToClient must be called with the pool locked.
 func (sp *SignalingPeer) sendToClient(evt *NetworkEvent) {
 	if sp.state != SignalingConnectionStateConnected {
+		sp.connectionPool.metrics.countDrop(sp.app(), DropNotConnected, 1)
+		return
+	}
+	select {
+	case sp.send <- queuedEvent{evt: evt, queued: time.Now()}:
+	default:
+		sp.connectionPool.metrics.countDrop(sp.app(), DropQueueFull, 1)
+		// the pool is locked, Close has to wait for the caller to finish. One
+		// closer is enough however many events overflow meanwhile.
+		if atomic.CompareAndSwapInt32(&sp.overflowed, 0, 1) {
+			sp.startPump(func() { sp.Close(DisconnectQueueFull) })
+		}
 		return
 	}
-	sp.send <- evt
+	if sp.lowMemory && atomic.CompareAndSwapInt32(&sp.writing, 0, 1) {
+		sp.startPump(sp.drainSend)
+	}
 }
 
 func (sp *SignalingPeer) Cleanup() {
-	if sp.state == SignalingConnectionStateDisconnection || sp.state == SignalingConnectionStateDisconnected {
-		return
-	}
+	sp.Close(DisconnectServerClosed)
+}
+
+// Close disconnects the peer. Only the first call has an effect: the linked
+// peers are told, the pumps are stopped and the socket is closed. Close must
+// not be called with the pool locked.
+func (sp *SignalingPeer) Close(reason DisconnectReason) {
+	sp.closeOnce.Do(func() {
+		sp.reason = reason
+		sp.cancel()
+		sp.connectionPool.metrics.countDisconnect(sp.app(), reason)
+
+		pool := sp.connectionPool
+		pool.mu.Lock()
+		sp.state = SignalingConnectionStateDisconnection
+		if sp.expiry != nil {
+			sp.expiry.Stop()
+		}
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapDisconnected, Address: sp.scopeAddress(), Reason: string(reason)}, nil)
+		}
+		sp.leavePool()
+		left := pool.count()
+		pool.mu.Unlock()
 
-	sp.state = SignalingConnectionStateDisconnection
-	log.Println(sp.GetName(), " disconnection.")
+		if sp.ipLimit != nil {
+			sp.ipLimit.release(sp.ip)
+		}
+		if sp.lowMemory {
+			pool.server.pinger.remove(sp)
+		}
+		if sp.polled {
+			pool.server.poller.remove(sp)
+		}
+		if code := reason.closeCode(); code != 0 {
+			sp.socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, string(reason)), time.Now().Add(writeWait))
+		}
+		sp.socket.Close()
+		sp.log(LevelInfo, "peer disconnected", F("reason", reason), F("peers_left", left))
+
+		pool.mu.Lock()
+		sp.state = SignalingConnectionStateDisconnected
+		pool.mu.Unlock()
+		sp.release()
+	})
+}
+
+func (sp *SignalingPeer) leavePool() {
 	sp.connectionPool.removeConnection(sp)
 
+	for _, k := range sp.knocking {
+		k.cancel()
+	}
+
 	// disconnect all connections
 	for k := range sp.connections {
 		sp.disconnect(NewConnectionId(k))
@@ -81,27 +403,28 @@ func (sp *SignalingPeer) Cleanup() {
 	if sp.serverAddress != nil {
 		sp.stopServer()
 	}
-
-	sp.socket.Close()
-
-	log.Println(sp.GetName(), "removed", sp.connectionPool.count(), "connections left.")
-	sp.state = SignalingConnectionStateDisconnected
 }
 
 func (sp *SignalingPeer) handleIncomingEvent(evt *NetworkEvent) {
 	switch evt.Type {
 	case NetEventTypeNewConnection:
-		addr := evt.GetInfo().StringData
-		if addr != nil {
-			sp.connect(*addr, evt.ConnectionId)
+		// a listener accepts a join request without an address
+		info := evt.GetInfo()
+		if info == nil || info.StringData == nil || *info.StringData == "" {
+			if sp.answerKnock(evt.ConnectionId, true) {
+				return
+			}
+		}
+		if info != nil && info.StringData != nil {
+			sp.connect(*info.StringData, evt.ConnectionId)
 		}
 	case NetEventTypeConnectionFailed:
+		sp.answerKnock(evt.ConnectionId, false)
 	case NetEventTypeDisconnected:
 		sp.disconnect(evt.ConnectionId)
 	case NetEventTypeServerInitialized:
-		addr := evt.GetInfo().StringData
-		if addr != nil {
-			sp.startServer(*addr)
+		if info := evt.GetInfo(); info != nil && info.StringData != nil {
+			sp.startServer(*info.StringData)
 		}
 	case NetEventTypeServerInitFailed:
 	case NetEventTypeServerClosed:
@@ -115,26 +438,52 @@ func (sp *SignalingPeer) handleIncomingEvent(evt *NetworkEvent) {
 
 func (sp *SignalingPeer) internalAddIncomingPeer(peer *SignalingPeer) {
 	id := sp.nextConnectionId()
-	sp.connections[id.ID] = peer
+	sp.linkPeer(id.ID, peer)
 	sp.sendToClient(NewNetworkEvent(NetEventTypeNewConnection, id, &NetEventData{Type: NetEventDataTypeNull}))
 }
 
 func (sp *SignalingPeer) internalAddOutgoingPeer(peer *SignalingPeer, id *ConnectionId) {
-	sp.connections[id.ID] = peer
+	sp.linkPeer(id.ID, peer)
 	sp.sendToClient(NewNetworkEvent(NetEventTypeNewConnection, id, &NetEventData{Type: NetEventDataTypeNull}))
 }
 
 func (sp *SignalingPeer) internalRemovePeer(id *ConnectionId) {
-	delete(sp.connections, id.ID)
+	sp.unlinkPeer(id.ID)
 	sp.sendToClient(NewNetworkEvent(NetEventTypeDisconnected, id, &NetEventData{Type: NetEventDataTypeNull}))
 }
 
-func (sp *SignalingPeer) findPeerConnectionId(otherPeer *SignalingPeer) *ConnectionId {
-	for k, v := range sp.connections {
-		if v.connInfo != otherPeer.connInfo {
-			continue
+// linkPeer and unlinkPeer keep connectionIds, the reverse index of
+// connections, in sync. A peer usually has a single id, but a client may
+// connect to the same address more than once.
+func (sp *SignalingPeer) linkPeer(id int16, peer *SignalingPeer) {
+	sp.unlinkPeer(id)
+	sp.connections[id] = peer
+	sp.connectionIds[peer] = append(sp.connectionIds[peer], id)
+}
+
+func (sp *SignalingPeer) unlinkPeer(id int16) {
+	peer, ok := sp.connections[id]
+	if !ok {
+		return
+	}
+	delete(sp.connections, id)
+	ids := sp.connectionIds[peer]
+	for i, v := range ids {
+		if v == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
 		}
-		return NewConnectionId(k)
+	}
+	if len(ids) == 0 {
+		delete(sp.connectionIds, peer)
+	} else {
+		sp.connectionIds[peer] = ids
+	}
+}
+
+func (sp *SignalingPeer) findPeerConnectionId(otherPeer *SignalingPeer) *ConnectionId {
+	if ids, ok := sp.connectionIds[otherPeer]; ok {
+		return NewConnectionId(ids[0])
 	}
 	return nil
 }
@@ -145,12 +494,62 @@ func (sp *SignalingPeer) nextConnectionId() *ConnectionId {
 	return result
 }
 
-func (sp *SignalingPeer) connect(address string, id *ConnectionId) {
+// startSpan starts a span in the trace of the peer's upgrade, it returns nil
+// unless that trace is sampled.
+func (sp *SignalingPeer) startSpan(name string, fields ...Field) *Span {
+	return sp.connectionPool.server.tracer.Start(sp.trace, name, append(fields, F("app", sp.app()), F("peer", sp.id))...)
+}
+
+func (sp *SignalingPeer) connect(raw string, id *ConnectionId) {
+	address, access := splitAddress(raw)
+	var span *Span
+	if sp.trace.Sampled {
+		span = sp.startSpan("connect", F("address", address), F("connection_id", id.ID))
+		defer span.End()
+	}
+	if sp.connectionPool.addressTooLong(raw) {
+		span.SetError(errAddressTooLong)
+		sp.sendToClient(NewNetworkEvent(NetEventTypeConnectionFailed, id, &NetEventData{Type: NetEventDataTypeNull}))
+		return
+	}
+	if reason := sp.refuseConnect(address); reason != "" {
+		span.SetError(errors.New(reason))
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapLinkFailed, Address: address, ConnectionId: &id.ID, Reason: reason}, nil)
+		}
+		sp.sendToClient(NewNetworkEvent(NetEventTypeConnectionFailed, id, &NetEventData{Type: NetEventDataTypeNull}))
+		return
+	}
 	sc := sp.connectionPool.getServerConnection(address)
 	if sc != nil && len(sc) == 1 {
+		if reason := sp.connectionPool.admit(address, access); reason != "" {
+			span.SetError(errors.New(reason))
+			if sp.taps().enabled() {
+				sp.publish(TapEvent{Kind: TapLinkFailed, Address: address, ConnectionId: &id.ID, Reason: TapReasonLocked}, nil)
+			}
+			sp.refuseAccess(address, reason)
+			sp.sendToClient(NewNetworkEvent(NetEventTypeConnectionFailed, id, &NetEventData{Type: NetEventDataTypeNull}))
+			return
+		}
+		if sp.connectionPool.appConfig.KnockToJoin {
+			sp.knock(sc[0], id, address, access.meta)
+			return
+		}
 		sc[0].internalAddIncomingPeer(sp)
 		sp.internalAddOutgoingPeer(sc[0], id)
+		sp.joined.Store(address)
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapLink, Address: address, OtherPeer: sc[0].id, ConnectionId: &id.ID}, nil)
+		}
+		if span != nil {
+			span.SetAttributes(F("listener", sc[0].id), F("listener_connection_id", sc[0].findPeerConnectionId(sp).ID))
+		}
+		span.Link(sc[0].trace)
 	} else {
+		span.SetError(errors.New("address not found"))
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapLinkFailed, Address: address, ConnectionId: &id.ID}, nil)
+		}
 		sp.sendToClient(NewNetworkEvent(NetEventTypeConnectionFailed, id, &NetEventData{Type: NetEventDataTypeNull}))
 	}
 }
@@ -159,31 +558,100 @@ func (sp *SignalingPeer) connectJoin(address string) {
 	sc := sp.connectionPool.getServerConnection(address)
 	if sc != nil {
 		for _, v := range sc {
-			if v.connInfo == sp.connInfo {
+			if v == sp {
 				continue
 			}
 			v.internalAddIncomingPeer(sp)
 			sp.internalAddIncomingPeer(v)
+			if sp.taps().enabled() {
+				sp.publish(TapEvent{Kind: TapLink, Address: address, OtherPeer: v.id}, nil)
+			}
 		}
 	}
 }
 
 func (sp *SignalingPeer) disconnect(id *ConnectionId) {
+	if k := sp.knocking[id.ID]; k != nil {
+		k.cancel()
+		return
+	}
+	if sp.answerKnock(id, false) {
+		return
+	}
 	otherPeer := sp.connections[id.ID]
 	if otherPeer != nil {
 		idOfOther := otherPeer.findPeerConnectionId(sp)
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapUnlink, Address: linkAddress(sp, otherPeer), OtherPeer: otherPeer.id, ConnectionId: &id.ID}, nil)
+		}
+		if sp.trace.Sampled {
+			span := sp.startSpan("disconnect", F("connection_id", id.ID), F("other_peer", otherPeer.id))
+			span.Link(otherPeer.trace)
+			defer span.End()
+		}
 		sp.internalRemovePeer(id)
-		otherPeer.internalRemovePeer(idOfOther)
+		if idOfOther != nil {
+			otherPeer.internalRemovePeer(idOfOther)
+		}
 	}
 }
 
-func (sp *SignalingPeer) startServer(address string) {
+func (sp *SignalingPeer) startServer(raw string) {
+	address, access := splitAddress(raw)
+	var span *Span
+	if sp.trace.Sampled {
+		span = sp.startSpan("startServer", F("address", address))
+		defer span.End()
+	}
+	if sp.connectionPool.addressTooLong(raw) {
+		span.SetError(errAddressTooLong)
+		sp.sendToClient(NewNetworkEvent(
+			NetEventTypeServerInitFailed,
+			INVALIDConnectionId,
+			&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &address},
+		))
+		return
+	}
+	if reason := sp.refuseListen(address); reason != "" {
+		span.SetError(errors.New(reason))
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapListenFailed, Address: address, Reason: reason}, nil)
+		}
+		sp.sendToClient(NewNetworkEvent(
+			NetEventTypeServerInitFailed,
+			INVALIDConnectionId,
+			&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &address},
+		))
+		return
+	}
 	if sp.serverAddress != nil {
 		sp.stopServer()
 	}
-	if sp.connectionPool.isAddressAvailable(address) {
+	pool := sp.connectionPool
+	if pool.isAddressAvailable(address) {
+		// the first listener locks the address, the others of a shared
+		// room have to get in like connectors
+		if pool.getServerConnection(address) == nil {
+			pool.lockAddress(address, access)
+		} else if reason := pool.admit(address, access); reason != "" {
+			span.SetError(errors.New(reason))
+			if sp.taps().enabled() {
+				sp.publish(TapEvent{Kind: TapListenFailed, Address: address, Reason: TapReasonLocked}, nil)
+			}
+			sp.refuseAccess(address, reason)
+			sp.sendToClient(NewNetworkEvent(
+				NetEventTypeServerInitFailed,
+				INVALIDConnectionId,
+				&NetEventData{Type: NetEventDataTypeUTF16String, StringData: &address},
+			))
+			return
+		}
 		sp.serverAddress = &address
+		sp.listening.Store(address)
 		sp.connectionPool.addServer(sp, address)
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapListen, Address: address}, nil)
+		}
 		sp.sendToClient(NewNetworkEvent(
 			NetEventTypeServerInitialized,
 			INVALIDConnectionId,
@@ -193,6 +661,10 @@ func (sp *SignalingPeer) startServer(address string) {
 			sp.connectJoin(address)
 		}
 	} else {
+		span.SetError(errors.New("address not available"))
+		if sp.taps().enabled() {
+			sp.publish(TapEvent{Kind: TapListenFailed, Address: address}, nil)
+		}
 		sp.sendToClient(NewNetworkEvent(
 			NetEventTypeServerInitFailed,
 			INVALIDConnectionId,
@@ -205,75 +677,262 @@ func (sp *SignalingPeer) stopServer() {
 	if sp.serverAddress == nil {
 		return
 	}
+	sp.dropKnocks()
 	sp.connectionPool.removeServer(sp, *sp.serverAddress)
+	if sp.taps().enabled() {
+		sp.publish(TapEvent{Kind: TapStop, Address: *sp.serverAddress}, nil)
+	}
 	sp.sendToClient(NewNetworkEvent(NetEventTypeServerClosed, INVALIDConnectionId, &NetEventData{Type: NetEventDataTypeNull}))
 	sp.serverAddress = nil
+	sp.listening.Store("")
 }
 
 func (sp *SignalingPeer) forwardMessage(senderPeer *SignalingPeer, msg *NetEventData, reliable bool) {
 	id := sp.findPeerConnectionId(senderPeer)
+	typ := NetEventTypeUnreliableMessageReceived
 	if reliable {
-		sp.sendToClient(NewNetworkEvent(NetEventTypeReliableMessageReceived, id, msg))
-	} else {
-		sp.sendToClient(NewNetworkEvent(NetEventTypeUnreliableMessageReceived, id, msg))
+		typ = NetEventTypeReliableMessageReceived
+	}
+	if senderPeer.trace.Sampled && id != nil {
+		span := senderPeer.startSpan("forwardMessage", F("address", linkAddress(senderPeer, sp)), F("event_type", NetEventTypeITS[typ]),
+			F("to_peer", sp.id), F("to_connection_id", id.ID))
+		span.Link(sp.trace)
+		defer span.End()
+	}
+	evt := NewNetworkEvent(typ, id, msg)
+	if senderPeer.taps().enabled() && id != nil {
+		senderPeer.publish(TapEvent{Kind: TapMessage, Address: linkAddress(senderPeer, sp), OtherPeer: sp.id,
+			ConnectionId: &id.ID, Type: NetEventTypeITS[typ], Size: len(msg.ObjectData)}, evt)
 	}
+	sp.sendToClient(evt)
 }
 
 func (sp *SignalingPeer) sendData(id *ConnectionId, msg *NetEventData, reliable bool) {
+	if msg == nil {
+		return
+	}
 	if peer, ok := sp.connections[id.ID]; ok {
 		peer.forwardMessage(sp, msg, reliable)
+	} else {
+		sp.connectionPool.metrics.countDrop(sp.app(), DropUnknownConnection, 1)
 	}
-
 }
 
 const (
 	writeWait      = 5 * time.Second
-	pongWait       = 5 * time.Second
-	pingPeriod     = 3 * time.Second
 	maxMessageSize = 1048576
 )
 
+// pongWait and pingPeriod are variables so tests can shorten them.
+var (
+	pongWait   = 5 * time.Second
+	pingPeriod = 3 * time.Second
+)
+
+var errInvalidMessage = errors.New("invalid message")
+
 func (sp *SignalingPeer) readPump() {
-	defer func() {
-		sp.Cleanup()
-	}()
 	sp.socket.SetReadLimit(maxMessageSize)
 	sp.socket.SetReadDeadline(time.Now().Add(pongWait))
-	sp.socket.SetPongHandler(func(string) error { sp.socket.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	sp.socket.SetPongHandler(func(string) error {
+		sp.socket.SetReadDeadline(time.Now().Add(pongWait))
+		sp.pong()
+		return nil
+	})
 	for {
 		_, msg, err := sp.socket.ReadMessage()
+		if err == nil {
+			err = sp.onMessage(msg)
+		}
 		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
-				log.Println(sp.GetName(), "CLOSED!")
-			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
-			} else {
-				log.Println(err)
-			}
+			sp.Close(sp.readErrorReason(err))
 			return
 		}
-		evt, err := FromByteArray(msg)
-		log.Println(sp.GetName(), "INC: ", evt.String())
+	}
+}
+
+func (sp *SignalingPeer) readErrorReason(err error) DisconnectReason {
+	if sp.ctx.Err() != nil {
+		// the socket was closed by Close, which already has a reason
+		return DisconnectServerClosed
+	}
+	if errors.Cause(err) == errInvalidMessage || err == websocket.ErrReadLimit {
+		sp.log(LevelWarn, "invalid message", F("error", err))
+		return DisconnectProtocolError
+	}
+	if err == errRateLimited {
+		sp.log(LevelWarn, "rate limited")
+		return DisconnectRateLimited
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return DisconnectPingTimeout
+	}
+	if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway,
+		websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
+		sp.log(LevelWarn, "unexpected close", F("error", err))
+	}
+	if _, ok := err.(*websocket.CloseError); ok {
+		return DisconnectClientClosed
+	}
+	sp.log(LevelWarn, "read failed", F("error", err))
+	return DisconnectReadError
+}
+
+func (sp *SignalingPeer) onMessage(msg []byte) error {
+	if sp.limiter != nil {
+		if ok, err := sp.limit(len(msg)); !ok || err != nil {
+			return err
+		}
+	}
+	evt, err := FromByteArray(msg)
+	if err != nil {
+		return errors.Wrap(errInvalidMessage, err.Error())
+	}
+	sp.logEvent(DirectionIn, evt, len(msg))
+	sp.recordEvent(DirectionIn, evt)
+	sp.connectionPool.metrics.countEvent(sp.app(), evt, DirectionIn, len(msg))
+
+	pool := sp.connectionPool
+	pool.mu.Lock()
+	if sp.state == SignalingConnectionStateConnected {
 		sp.handleIncomingEvent(evt)
 	}
+	pool.mu.Unlock()
+	return nil
 }
 
 func (sp *SignalingPeer) writePump() {
 	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		sp.Cleanup()
-	}()
+	defer ticker.Stop()
 	for {
 		select {
+		case <-sp.ctx.Done():
+			return
 		case <-ticker.C:
+			sp.pingSent()
 			sp.socket.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := sp.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				sp.Close(DisconnectWriteError)
+				return
+			}
+		case qe := <-sp.send:
+			if err := sp.writeEvent(qe); err != nil {
+				sp.Close(DisconnectWriteError)
+				return
+			}
+		}
+	}
+}
+
+func (sp *SignalingPeer) writeEvent(qe queuedEvent) error {
+	metrics := sp.connectionPool.metrics
+	metrics.observeQueueWait(sp.app(), time.Since(qe.queued))
+	msg := qe.evt.ToByteArray()
+	sp.logEvent(DirectionOut, qe.evt, len(msg))
+	sp.recordEvent(DirectionOut, qe.evt)
+	metrics.countEvent(sp.app(), qe.evt, DirectionOut, len(msg))
+	sp.socket.SetWriteDeadline(time.Now().Add(writeWait))
+	return sp.socket.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// drainSend writes the queued events of a low memory peer and exits once the
+// queue is empty, so idle peers don't keep a writer goroutine around.
+func (sp *SignalingPeer) drainSend() {
+	for sp.ctx.Err() == nil {
+		select {
+		case qe := <-sp.send:
+			if err := sp.writeEvent(qe); err != nil {
+				sp.Close(DisconnectWriteError)
+				return
+			}
+		default:
+			atomic.StoreInt32(&sp.writing, 0)
+			// an event queued between the empty check and the reset must not be stranded
+			if len(sp.send) == 0 || !atomic.CompareAndSwapInt32(&sp.writing, 0, 1) {
 				return
 			}
-		case evt := <-sp.send:
-			log.Printf("%s OUT: %s", sp.GetName(), evt.String())
-			sp.socket.WriteMessage(websocket.BinaryMessage, evt.ToByteArray())
 		}
 	}
 }
+
+// ping is called by the shared pinger of low memory peers.
+func (sp *SignalingPeer) ping() {
+	if sp.polled && time.Since(time.Unix(0, atomic.LoadInt64(&sp.lastPong))) > pongWait {
+		sp.Close(DisconnectPingTimeout)
+		return
+	}
+	sp.pingSent()
+	if err := sp.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+		sp.Close(DisconnectWriteError)
+	}
+}
+
+// pollRead is started by the netpoll loop once the socket is readable. It
+// reads until the buffered reader is drained and re-arms the socket.
+func (sp *SignalingPeer) pollRead() {
+	for {
+		if err := sp.readFrame(); err != nil {
+			sp.Close(sp.readErrorReason(err))
+			return
+		}
+		if sp.reader.Buffered() == 0 {
+			break
+		}
+	}
+	if sp.ctx.Err() != nil {
+		return
+	}
+	if err := sp.connectionPool.server.poller.rearm(sp); err != nil {
+		sp.log(LevelWarn, "netpoll rearm failed", F("error", err))
+		sp.Close(DisconnectReadError)
+	}
+}
+
+// readFrame reads one data message or consumes one ping/pong frame. Control
+// frames are handled here instead of by gorilla, because NextReader would keep
+// waiting for the next data frame and park the goroutine of an idle peer.
+func (sp *SignalingPeer) readFrame() error {
+	sp.socket.SetReadLimit(maxMessageSize)
+	sp.socket.SetReadDeadline(time.Now().Add(pongWait))
+	head, err := sp.reader.Peek(2)
+	if err != nil {
+		return err
+	}
+	opcode := int(head[0] & 0x0f)
+	fin := head[0]&0xf0 == 0x80
+	length := int(head[1] & 0x7f)
+	if !fin || length > 125 || (opcode != websocket.PingMessage && opcode != websocket.PongMessage) {
+		_, msg, err := sp.socket.ReadMessage()
+		if err != nil {
+			return err
+		}
+		return sp.onMessage(msg)
+	}
+
+	size := 2 + length
+	masked := head[1]&0x80 != 0
+	if masked {
+		size += 4
+	}
+	frame, err := sp.reader.Peek(size)
+	if err != nil {
+		return err
+	}
+	if opcode == websocket.PingMessage {
+		payload := make([]byte, length)
+		copy(payload, frame[size-length:])
+		if masked {
+			key := frame[2:6]
+			for i := range payload {
+				payload[i] ^= key[i%4]
+			}
+		}
+		if err := sp.socket.WriteControl(websocket.PongMessage, payload, time.Now().Add(writeWait)); err != nil {
+			return err
+		}
+	} else {
+		sp.pong()
+	}
+	_, err = sp.reader.Discard(size)
+	return err
+}
@@ -0,0 +1,153 @@
+package signalsrv
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newTestPeer creates a connected peer without a socket or pumps, events sent
+// to the client stay in the send queue.
+func newTestPeer(pool *PeerPool, name string, queue int) *SignalingPeer {
+	sp := &SignalingPeer{
+		id:                       nextPeerId(),
+		state:                    SignalingConnectionStateConnected,
+		connections:              make(map[int16]*SignalingPeer),
+		connectionIds:            make(map[*SignalingPeer][]int16),
+		nextIncomingConnectionId: NewConnectionId(16384),
+		connInfo:                 name,
+		connectionPool:           pool,
+		send:                     make(chan queuedEvent, queue),
+	}
+	pool.slots[sp] = len(pool.connections)
+	pool.connections = append(pool.connections, sp)
+	pool.ids[sp.id] = sp
+	return sp
+}
+
+func drain(sp *SignalingPeer) []*NetworkEvent {
+	var events []*NetworkEvent
+	for len(sp.send) > 0 {
+		events = append(events, (<-sp.send).evt)
+	}
+	return events
+}
+
+func newTestRoom(size int) (*PeerPool, []*SignalingPeer) {
+	pool := NewPeerPool(nil, &AppConfig{AppName: "Test", AddressSharing: true})
+	peers := make([]*SignalingPeer, size)
+	for i := range peers {
+		peers[i] = newTestPeer(pool, fmt.Sprintf("peer%d", i), size+1)
+		peers[i].startServer("room")
+		drain(peers[i])
+	}
+	return pool, peers
+}
+
+func TestConnectionIndex(t *testing.T) {
+	pool, peers := newTestRoom(3)
+
+	for _, sp := range peers {
+		if want, got := 2, len(sp.connections); want != got {
+			t.Errorf("expected %d connections got: %d", want, got)
+		}
+		for id, other := range sp.connections {
+			if got := sp.findPeerConnectionId(other); got == nil || got.ID != id {
+				t.Errorf("expected connection id %d got: %v", id, got)
+			}
+		}
+	}
+
+	peers[1].leavePool()
+	for _, sp := range peers {
+		drain(sp)
+	}
+	if want, got := 2, pool.count(); want != got {
+		t.Errorf("expected %d peers got: %d", want, got)
+	}
+	if want, got := 2, len(pool.getServerConnection("room")); want != got {
+		t.Errorf("expected %d listeners got: %d", want, got)
+	}
+	for _, sp := range []*SignalingPeer{peers[0], peers[2]} {
+		if got := sp.findPeerConnectionId(peers[1]); got != nil {
+			t.Errorf("expected no connection id got: %d", got.ID)
+		}
+		if got := pool.slots[sp]; pool.connections[got] != sp {
+			t.Errorf("expected peer in slot %d", got)
+		}
+		if got := pool.serverSlots[sp]; pool.servers["room"][got] != sp {
+			t.Errorf("expected listener in slot %d", got)
+		}
+	}
+
+	peers[0].leavePool()
+	peers[2].leavePool()
+	if want, got := 0, pool.count(); want != got {
+		t.Errorf("expected %d peers got: %d", want, got)
+	}
+	if got := pool.getServerConnection("room"); got != nil {
+		t.Errorf("expected address to be released got: %d listeners", len(got))
+	}
+}
+
+func TestSameRemoteAddress(t *testing.T) {
+	pool := NewPeerPool(nil, &AppConfig{AppName: "Test", AddressSharing: true})
+	a := newTestPeer(pool, "10.0.0.1:5000", 8)
+	b := newTestPeer(pool, "10.0.0.1:5000", 8)
+	if a.ID() == b.ID() {
+		t.Errorf("expected unique peer ids got: %d and %d", a.ID(), b.ID())
+	}
+
+	a.startServer("room")
+	b.startServer("room")
+	if want, got := 1, len(a.connections); want != got {
+		t.Errorf("expected %d connections got: %d", want, got)
+	}
+	if want, got := 1, len(b.connections); want != got {
+		t.Errorf("expected %d connections got: %d", want, got)
+	}
+
+	b.leavePool()
+	if want, got := 1, pool.count(); want != got {
+		t.Errorf("expected %d peers got: %d", want, got)
+	}
+	if pool.connections[0] != a {
+		t.Errorf("expected peer %s to stay in the pool", a.GetName())
+	}
+}
+
+func BenchmarkSendData(b *testing.B) {
+	for _, size := range []int{2, 20, 200} {
+		b.Run(fmt.Sprintf("room-%d", size), func(b *testing.B) {
+			_, peers := newTestRoom(size)
+			sender, receiver := peers[0], peers[size-1]
+			id := sender.findPeerConnectionId(receiver)
+			msg := &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte("hello")}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sender.sendData(id, msg, true)
+				<-receiver.send
+			}
+		})
+	}
+}
+
+func BenchmarkRemoveConnection(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		b.Run(fmt.Sprintf("pool-%d", size), func(b *testing.B) {
+			pool := NewPeerPool(nil, &AppConfig{AppName: "Test"})
+			for i := 0; i < size; i++ {
+				newTestPeer(pool, fmt.Sprintf("peer%d", i), 1)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sp := pool.connections[i%size]
+				pool.removeConnection(sp)
+				pool.slots[sp] = len(pool.connections)
+				pool.connections = append(pool.connections, sp)
+			}
+		})
+	}
+}
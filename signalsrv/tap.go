@@ -0,0 +1,221 @@
+package signalsrv
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const tapQueueSize = 1024
+
+// Kinds of TapEvent.
+const (
+	TapConnected    = "connected"
+	TapListen       = "listen"
+	TapListenFailed = "listen_failed"
+	TapStop         = "stop"
+	TapLink         = "link"
+	TapLinkFailed   = "link_failed"
+	TapMessage      = "message"
+	TapUnlink       = "unlink"
+	TapDisconnected = "disconnected"
+	TapDropped      = "dropped"
+)
+
+// Reasons of listen_failed and link_failed events. TapReasonDenied means the
+// claims of the peer didn't allow it, TapReasonBanned that the address is
+// banned, TapReasonLocked that the peer lacked its secret or an invite and
+// TapReasonKnock that its join request wasn't accepted.
+const (
+	TapReasonDenied = "denied"
+	TapReasonBanned = "banned"
+	TapReasonLocked = "locked"
+	TapReasonKnock  = "knock"
+)
+
+// TapEvent is a routing event streamed to the admin event tap.
+type TapEvent struct {
+	Time         time.Time `json:"time"`
+	Kind         string    `json:"kind"`
+	App          string    `json:"app,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	Peer         PeerId    `json:"peer,omitempty"`
+	OtherPeer    PeerId    `json:"other_peer,omitempty"`
+	ConnectionId *int16    `json:"connection_id,omitempty"`
+	Type         string    `json:"type,omitempty"`
+	Size         int       `json:"size,omitempty"`
+	Payload      *string   `json:"payload,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Count        uint64    `json:"count,omitempty"`
+}
+
+// tap is one subscriber, it gets the events of an app or of a single address.
+type tap struct {
+	app      string
+	address  string
+	payloads bool
+	events   chan tapItem
+	dropped  uint64
+}
+
+// tapItem is a queued event, its payload is decoded and redacted by the tap's
+// own goroutine instead of the routing one.
+type tapItem struct {
+	evt     TapEvent
+	payload *NetworkEvent
+}
+
+func (t *tap) matches(app, address string) bool {
+	return t.app == app && (t.address == "" || t.address == address)
+}
+
+// tapHub fans routing events out to the subscribed taps. Publishing never
+// blocks, a tap that can't keep up loses events and is told how many.
+type tapHub struct {
+	mu     sync.RWMutex
+	taps   map[*tap]struct{}
+	active int32
+}
+
+func newTapHub() *tapHub {
+	return &tapHub{taps: make(map[*tap]struct{})}
+}
+
+func (h *tapHub) subscribe(t *tap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.taps[t] = struct{}{}
+	atomic.StoreInt32(&h.active, int32(len(h.taps)))
+}
+
+func (h *tapHub) unsubscribe(t *tap) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.taps, t)
+	atomic.StoreInt32(&h.active, int32(len(h.taps)))
+}
+
+// enabled is the cheap check done before an event is built.
+func (h *tapHub) enabled() bool {
+	return h != nil && atomic.LoadInt32(&h.active) > 0
+}
+
+// publish sends evt to the matching taps, payload only to those that asked
+// for payloads.
+func (h *tapHub) publish(evt TapEvent, payload *NetworkEvent) {
+	if !h.enabled() {
+		return
+	}
+	evt.Time = time.Now()
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for t := range h.taps {
+		if !t.matches(evt.App, evt.Address) {
+			continue
+		}
+		item := tapItem{evt: evt}
+		if t.payloads {
+			item.payload = payload
+		}
+		select {
+		case t.events <- item:
+		default:
+			atomic.AddUint64(&t.dropped, 1)
+		}
+	}
+}
+
+func (sp *SignalingPeer) taps() *tapHub {
+	if server := sp.connectionPool.server; server != nil {
+		return server.taps
+	}
+	return nil
+}
+
+// linkAddress is the address of whichever of two linked peers listens.
+func linkAddress(a, b *SignalingPeer) string {
+	if address := a.address(); address != "" {
+		return address
+	}
+	return b.address()
+}
+
+var tapUpgrader = websocket.Upgrader{
+	// the admin token protects the tap, browsers on other origins may use it
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// serveTap streams the events of the app and optional address as JSON text
+// messages until the client goes away or the server shuts down.
+func (wns *WebsocketNetworkServer) serveTap(w http.ResponseWriter, r *http.Request, app, address string, payloads bool) {
+	conn, err := tapUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	t := &tap{app: app, address: address, payloads: payloads, events: make(chan tapItem, tapQueueSize)}
+	wns.taps.subscribe(t)
+	defer wns.taps.unsubscribe(t)
+	defer conn.Close()
+
+	// the client only answers pings, which keep the read deadline ahead
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error { conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var reported uint64
+	reportDropped := func() error {
+		dropped := atomic.LoadUint64(&t.dropped)
+		if dropped == reported {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		err := conn.WriteJSON(TapEvent{Time: time.Now(), Kind: TapDropped, Count: dropped - reported})
+		reported = dropped
+		return err
+	}
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+			if err := reportDropped(); err != nil {
+				return
+			}
+		case <-wns.ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, string(DisconnectServerShutdown)),
+				time.Now().Add(writeWait))
+			return
+		case item := <-t.events:
+			evt := item.evt
+			if item.payload != nil {
+				var rec Record
+				rec.setEvent(item.payload, true)
+				evt.Payload = rec.Data
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteJSON(evt); err != nil {
+				return
+			}
+			if err := reportDropped(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package signalsrv
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialTap(t *testing.T, api *AdminAPI, query string) (*websocket.Conn, func()) {
+	ts := httptest.NewServer(api)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/tap?"+query, nil)
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		ts.Close()
+	}
+}
+
+func expectTap(t *testing.T, conn *websocket.Conn, kind string) TapEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var evt TapEvent
+	if err := conn.ReadJSON(&evt); err != nil {
+		t.Fatalf("expected %s got: %v", kind, err)
+	}
+	if evt.Kind != kind {
+		t.Fatalf("expected %s got: %+v", kind, evt)
+	}
+	return evt
+}
+
+func TestTap(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+	api := NewAdminAPI(wns, "secret")
+
+	ts := httptest.NewServer(api)
+	_, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/tap?app=Test&token=wrong", nil)
+	ts.Close()
+	if err == nil {
+		t.Fatal("expected the tap to require the admin token")
+	}
+
+	tap, closeTap := dialTap(t, api, "token=secret&app=Test&address=room&payloads=true")
+	defer closeTap()
+	for !wns.taps.enabled() {
+		time.Sleep(time.Millisecond)
+	}
+
+	other := dialTestClient(t, url)
+	defer other.conn.Close()
+	other.send(t, NetEventTypeServerInitialized, -1, "other")
+	other.expect(t, NetEventTypeServerInitialized)
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room")
+	listener.expect(t, NetEventTypeServerInitialized)
+	if want, got := "room", expectTap(t, tap, TapListen).Address; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+
+	connector := dialTestClient(t, url)
+	defer connector.conn.Close()
+	connector.send(t, NetEventTypeNewConnection, 1, "room")
+	connector.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+	link := expectTap(t, tap, TapLink)
+	if link.ConnectionId == nil || *link.ConnectionId != 1 {
+		t.Errorf("expected connection id 1 got: %+v", link)
+	}
+
+	evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(1), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte(`{"sdp":"c=IN IP4 10.1.2.3"}`)})
+	if err := connector.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+		t.Fatal(err)
+	}
+	listener.expect(t, NetEventTypeReliableMessageReceived)
+	msg := expectTap(t, tap, TapMessage)
+	if want, got := "room", msg.Address; want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	if msg.Payload == nil || !strings.Contains(*msg.Payload, "x.x.x.x") {
+		t.Errorf("expected a redacted payload got: %+v", msg)
+	}
+
+	connector.conn.Close()
+	listener.expect(t, NetEventTypeDisconnected)
+	if want, got := string(DisconnectClientClosed), expectTap(t, tap, TapDisconnected).Reason; want != got && got != string(DisconnectReadError) {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	expectTap(t, tap, TapUnlink)
+}
+
+func TestTapNeverBlocks(t *testing.T) {
+	hub := newTapHub()
+	slow := &tap{app: "Test", events: make(chan tapItem, 1)}
+	hub.subscribe(slow)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			hub.publish(TapEvent{Kind: TapMessage, App: "Test"}, nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on a slow tap")
+	}
+	if want, got := uint64(99), slow.dropped; want != got {
+		t.Errorf("expected %d dropped got: %d", want, got)
+	}
+	hub.unsubscribe(slow)
+	if hub.enabled() {
+		t.Error("expected the hub to be idle")
+	}
+}
+
+func TestTapReportsDroppedIdle(t *testing.T) {
+	defer func(ping time.Duration) { pingPeriod = ping }(pingPeriod)
+	pingPeriod = 20 * time.Millisecond
+	wns, _, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer closeServer()
+
+	conn, closeTap := dialTap(t, NewAdminAPI(wns, "secret"), "token=secret&app=Test")
+	defer closeTap()
+	for !wns.taps.enabled() {
+		time.Sleep(time.Millisecond)
+	}
+	wns.taps.mu.RLock()
+	for tap := range wns.taps.taps {
+		atomic.AddUint64(&tap.dropped, 5)
+	}
+	wns.taps.mu.RUnlock()
+	if want, got := uint64(5), expectTap(t, conn, TapDropped).Count; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+}
@@ -0,0 +1,175 @@
+package signalsrv
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var certCheckInterval = 10 * time.Second
+
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion and MaxVersion are like "1.2" or "1.3", empty keeps the
+	// crypto/tls defaults.
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are crypto/tls cipher suite names, they only apply to
+	// TLS 1.2 and older. Empty keeps the crypto/tls defaults.
+	CipherSuites []string
+	// RequestClientCerts asks clients for a certificate without requiring
+	// one, apps with ClientCerts verify it.
+	RequestClientCerts bool
+	// Logger reports failed certificate reloads.
+	Logger Logger
+}
+
+// NewTLSConfig returns a server config that serves the certificate files and
+// picks up a rotated certificate without a restart.
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	certs, err := NewCertReloader(opts.CertFile, opts.KeyFile, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		// websocket upgrades need HTTP/1.1, gorilla can't hijack HTTP/2
+		NextProtos: []string{"http/1.1"},
+	}
+	if opts.RequestClientCerts {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	if config.MinVersion, err = ParseTLSVersion(opts.MinVersion); err != nil {
+		return nil, err
+	}
+	if config.MaxVersion, err = ParseTLSVersion(opts.MaxVersion); err != nil {
+		return nil, err
+	}
+	if config.CipherSuites, err = ParseCipherSuites(opts.CipherSuites); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ParseTLSVersion parses "1.0" to "1.3", an empty version is 0.
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "tls") {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.Errorf("unknown tls version %q", s)
+}
+
+// ParseCipherSuites looks up cipher suites by their crypto/tls names.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, errors.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// CertReloader serves a certificate and key file pair. The files are checked
+// for changes at most every 10 seconds while handshakes happen, a pair that
+// fails to load keeps the previous certificate.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func NewCertReloader(certFile, keyFile string, logger Logger) (*CertReloader, error) {
+	if logger == nil {
+		logger = NewTextLogger(os.Stderr)
+	}
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, logger: logger, checked: time.Now()}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if !c.latestModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				c.logger.Log(LevelWarn, "certificate reload failed", F("cert", c.certFile), F("error", err))
+			} else {
+				c.logger.Log(LevelInfo, "certificate reloaded", F("cert", c.certFile))
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *CertReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// load must be called with c.mu locked or before c is shared.
+func (c *CertReloader) load() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "load certificate")
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// RedirectHTTPS redirects plain HTTP requests to the same host and path on
+// the HTTPS address.
+func RedirectHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,163 @@
+package signalsrv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testCert creates a certificate for name signed by parent, or a self-signed
+// CA if parent is nil.
+func testCert(t *testing.T, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"awsignal"}},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeCert(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func servedSerial(t *testing.T, url string) int64 {
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.UnderlyingConn().(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLS(t *testing.T) {
+	defer func(d time.Duration) { certCheckInterval = d }(certCheckInterval)
+	certCheckInterval = 0
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := NewTLSConfig(TLSOptions{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: filepath.Join(dir, "missing.key")}); err == nil {
+		t.Error("expected missing certificate files to fail")
+	}
+	cert, key := testCert(t, "localhost", 1, nil, nil)
+	certFile, keyFile := writeCert(t, dir, "server", cert, key)
+
+	config, err := NewTLSConfig(TLSOptions{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := uint16(tls.VersionTLS12), config.MinVersion; want != got {
+		t.Errorf("expected %d got: %d", want, got)
+	}
+
+	wns := NewWebsocketNetworkServer(nil)
+	defer wns.Shutdown(context.Background())
+	app := &AppConfig{Path: "/", AppName: "Test"}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wns.HandleUpgrade(w, r, app)
+	}))
+	// StartTLS would install its own certificate
+	ts.Listener = tls.NewListener(ts.Listener, config)
+	ts.Start()
+	defer ts.Close()
+	url := "wss" + strings.TrimPrefix(ts.URL, "http")
+
+	if want, got := int64(1), servedSerial(t, url); want != got {
+		t.Errorf("expected serial %d got: %d", want, got)
+	}
+
+	// a half written rotation keeps the old certificate
+	ioutil.WriteFile(keyFile, nil, 0600)
+	if want, got := int64(1), servedSerial(t, url); want != got {
+		t.Errorf("expected serial %d got: %d", want, got)
+	}
+	cert, key = testCert(t, "localhost", 2, nil, nil)
+	writeCert(t, dir, "server", cert, key)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if want, got := int64(2), servedSerial(t, url); want != got {
+		t.Errorf("expected serial %d got: %d", want, got)
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Error("expected an unknown version to fail")
+	}
+	if v, _ := ParseTLSVersion("TLS1.3"); v != tls.VersionTLS13 {
+		t.Errorf("expected %d got: %d", tls.VersionTLS13, v)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_NOPE"}); err == nil {
+		t.Error("expected an unknown cipher suite to fail")
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	for addr, want := range map[string]string{
+		":443":  "https://example.com/room?x=1",
+		":8443": "https://example.com:8443/room?x=1",
+	} {
+		w := httptest.NewRecorder()
+		RedirectHTTPS(addr).ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:8080/room?x=1", nil))
+		if got := w.Header().Get("Location"); want != got {
+			t.Errorf("expected %s got: %s", want, got)
+		}
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("expected %d got: %d", http.StatusMovedPermanently, w.Code)
+		}
+	}
+}
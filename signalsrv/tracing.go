@@ -0,0 +1,387 @@
+package signalsrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	traceQueueSize = 4096
+	traceBatchSize = 512
+	// TraceParam is the handshake query parameter carrying a W3C traceparent.
+	TraceParam = "traceparent"
+)
+
+var traceFlushInterval = time.Second
+
+// SpanContext identifies a span within a trace. The zero value is invalid.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats sc as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errors.Errorf("invalid traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errors.Wrap(err, "invalid trace id")
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errors.Wrap(err, "invalid span id")
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, errors.Wrap(err, "invalid trace flags")
+	}
+	if !sc.IsValid() {
+		return sc, errors.Errorf("invalid traceparent %q", s)
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, nil
+}
+
+type TracerConfig struct {
+	// Endpoint is the OTLP/HTTP base url of the collector, spans are posted
+	// as JSON to Endpoint/v1/traces.
+	Endpoint    string
+	ServiceName string
+	// SampleRatio is the share of new traces that are recorded. Traces
+	// continued from a client keep the client's decision.
+	SampleRatio float64
+	// Logger reports failed exports, it defaults to a text logger on stderr.
+	Logger Logger
+}
+
+// Tracer records spans and exports them in batches from a single goroutine.
+// Ending a span never blocks, spans are dropped while the export queue is
+// full.
+type Tracer struct {
+	config  TracerConfig
+	client  *http.Client
+	spans   chan *Span
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	dropped uint64
+}
+
+func NewTracer(config TracerConfig) *Tracer {
+	if config.ServiceName == "" {
+		config.ServiceName = "awsignal"
+	}
+	if config.Logger == nil {
+		config.Logger = NewTextLogger(os.Stderr)
+	}
+	t := &Tracer{
+		config: config,
+		client: &http.Client{Timeout: 5 * time.Second},
+		spans:  make(chan *Span, traceQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Dropped is the number of spans lost because the export queue was full.
+func (t *Tracer) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Shutdown exports the queued spans and stops the tracer.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Start begins a span. With a valid parent the span joins the parent's trace
+// and is only recorded if the parent was sampled, otherwise it starts a new
+// trace. A nil Tracer or an unsampled parent return a nil Span, which is safe
+// to use.
+func (t *Tracer) Start(parent SpanContext, name string, fields ...Field) *Span {
+	if t == nil || (parent.IsValid() && !parent.Sampled) {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: time.Now(), fields: fields}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+		s.ctx.Sampled = true
+	} else {
+		putRandom(s.ctx.TraceID[:8])
+		putRandom(s.ctx.TraceID[8:])
+		s.ctx.Sampled = rand.Float64() < t.config.SampleRatio
+	}
+	putRandom(s.ctx.SpanID[:])
+	return s
+}
+
+func putRandom(b []byte) {
+	v := rand.Uint64() | 1
+	for i := range b {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			t.config.Logger.Log(LevelWarn, "trace export failed", F("spans", len(batch)), F("error", err))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) == traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(t.request(spans)); err != nil {
+		return errors.Wrap(err, "encode spans")
+	}
+	resp, err := t.client.Post(strings.TrimSuffix(t.config.Endpoint, "/")+"/v1/traces", "application/json", &buf)
+	if err != nil {
+		return errors.Wrap(err, "post spans")
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Span is a timed operation. Its methods may be called on a nil Span.
+type Span struct {
+	tracer *Tracer
+	ctx    SpanContext
+	parent [8]byte
+	name   string
+	start  time.Time
+	end    time.Time
+	fields []Field
+	links  []SpanContext
+	err    error
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+func (s *Span) SetAttributes(fields ...Field) {
+	if s == nil {
+		return
+	}
+	s.fields = append(s.fields, fields...)
+}
+
+// Link relates the span to a span of another trace, e.g. the peer on the
+// other side of a connection.
+func (s *Span) Link(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+	s.links = append(s.links, sc)
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+}
+
+func (s *Span) End() {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case s.tracer.spans <- s:
+	default:
+		atomic.AddUint64(&s.tracer.dropped, 1)
+	}
+}
+
+// OTLP/HTTP JSON encoding, ids are hex strings and 64 bit integers are
+// decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+const (
+	otlpSpanKindServer   = 2
+	otlpStatusCodeError  = 2
+	otlpInstrumentation  = "github.com/huaishan/awsignal/signalsrv"
+	otlpServiceNameField = "service.name"
+)
+
+func (t *Tracer) request(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.fields),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, l := range s.links {
+			span.Links = append(span.Links, otlpLink{TraceID: hex.EncodeToString(l.TraceID[:]), SpanID: hex.EncodeToString(l.SpanID[:])})
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: otlpStatusCodeError, Message: s.err.Error()}
+		}
+		out = append(out, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]Field{F(otlpServiceNameField, t.config.ServiceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: otlpInstrumentation}, Spans: out}},
+	}}}
+}
+
+func otlpAttributes(fields []Field) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(fields))
+	for _, f := range fields {
+		var v otlpValue
+		switch value := f.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case float64:
+			v.DoubleValue = &value
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, PeerId:
+			s := fmt.Sprint(value)
+			v.IntValue = &s
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		attrs = append(attrs, otlpAttribute{Key: f.Key, Value: v})
+	}
+	return attrs
+}
@@ -0,0 +1,170 @@
+package signalsrv
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testCollector is a local OTLP/HTTP collector keeping every received span.
+type testCollector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *testCollector) named(name string) []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []otlpSpan
+	for _, s := range c.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func attribute(s otlpSpan, key string) string {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestTraceparent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled {
+		t.Error("expected sampled span context")
+	}
+	if want, got := s, sc.Traceparent(); want != got {
+		t.Errorf("expected %s got: %s", want, got)
+	}
+	for _, invalid := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-xyz-00f067aa0ba902b7-01"} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	defer func(d time.Duration) { traceFlushInterval = d }(traceFlushInterval)
+	traceFlushInterval = 10 * time.Millisecond
+	collector := &testCollector{}
+	cs := httptest.NewServer(collector)
+	defer cs.Close()
+
+	tracer := NewTracer(TracerConfig{Endpoint: cs.URL, SampleRatio: 1})
+	_, url, closeServer := newTestServer(t, &ServerConfig{Tracer: tracer, TracePropagation: true}, &AppConfig{Path: "/", AppName: "Test"})
+
+	listener := dialTestClient(t, url)
+	defer listener.conn.Close()
+	listener.send(t, NetEventTypeServerInitialized, -1, "room")
+	listener.expect(t, NetEventTypeServerInitialized)
+
+	client := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	connector := dialTestClient(t, url+"/?"+TraceParam+"="+client)
+	defer connector.conn.Close()
+	connector.send(t, NetEventTypeNewConnection, 1, "room")
+	connector.expect(t, NetEventTypeNewConnection)
+	listener.expect(t, NetEventTypeNewConnection)
+	evt := NewNetworkEvent(NetEventTypeReliableMessageReceived, NewConnectionId(1), &NetEventData{Type: NetEventDataTypeByteArray, ObjectData: []byte("offer")})
+	if err := connector.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+		t.Fatal(err)
+	}
+	listener.expect(t, NetEventTypeReliableMessageReceived)
+	connector.send(t, NetEventTypeDisconnected, 1, "")
+	listener.expect(t, NetEventTypeDisconnected)
+
+	closeServer()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	upgrades := collector.named("upgrade")
+	if want, got := 2, len(upgrades); want != got {
+		t.Fatalf("expected %d upgrade spans got: %d", want, got)
+	}
+	var upgrade otlpSpan
+	for _, s := range upgrades {
+		if s.ParentSpanID == "00f067aa0ba902b7" {
+			upgrade = s
+		}
+	}
+	if want, got := "4bf92f3577b34da6a3ce929d0e0e4736", upgrade.TraceID; want != got {
+		t.Fatalf("expected the client trace %s got: %s", want, got)
+	}
+
+	for _, name := range []string{"connect", "forwardMessage", "disconnect"} {
+		spans := collector.named(name)
+		if want, got := 1, len(spans); want != got {
+			t.Fatalf("expected %d %s spans got: %d", want, name, got)
+		}
+		if want, got := upgrade.SpanID, spans[0].ParentSpanID; want != got {
+			t.Errorf("expected %s to be a child of the upgrade got parent: %s", name, got)
+		}
+		if want, got := 1, len(spans[0].Links); want != got {
+			t.Errorf("expected %d link of %s got: %d", want, name, got)
+		}
+		if want, got := "Test", attribute(spans[0], "app"); want != got {
+			t.Errorf("expected app %s got: %s", want, got)
+		}
+	}
+	connect := collector.named("connect")[0]
+	if want, got := "room", attribute(connect, "address"); want != got {
+		t.Errorf("expected address %s got: %s", want, got)
+	}
+	if want, got := "1", attribute(connect, "connection_id"); want != got {
+		t.Errorf("expected connection id %s got: %s", want, got)
+	}
+	if want, got := "ReliableMessageReceived", attribute(collector.named("forwardMessage")[0], "event_type"); want != got {
+		t.Errorf("expected event type %s got: %s", want, got)
+	}
+
+	start := collector.named("startServer")
+	if want, got := 1, len(start); want != got {
+		t.Fatalf("expected %d startServer spans got: %d", want, got)
+	}
+	if _, err := hex.DecodeString(start[0].TraceID); err != nil || start[0].TraceID == upgrade.TraceID {
+		t.Errorf("expected the listener in its own trace got: %s", start[0].TraceID)
+	}
+}
@@ -1,22 +1,310 @@
 package signalsrv
 
 import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 )
 
 type WebsocketNetworkServer struct {
-	pool map[string]*PeerPool
+	mu        sync.Mutex
+	pool      map[string]*PeerPool
+	config    *ServerConfig
+	upgrader  websocket.Upgrader
+	pinger    *pinger
+	poller    *netpoll
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closing   bool
+	draining  int32
+	adding    sync.WaitGroup
+	metrics   *Metrics
+	logger    Logger
+	verbosity *Verbosity
+	tracer    *Tracer
+	recorder  *Recorder
+	taps      *tapHub
+	ipLimits  map[string]*ipLimiter
+	bans      *BanList
+}
+
+func NewWebsocketNetworkServer(config *ServerConfig) *WebsocketNetworkServer {
+	if config == nil {
+		config = &ServerConfig{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wns := &WebsocketNetworkServer{
+		pool:     make(map[string]*PeerPool),
+		ipLimits: make(map[string]*ipLimiter),
+		config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  config.ReadBufferSize,
+			WriteBufferSize: config.WriteBufferSize,
+			CheckOrigin:     allowOrigin,
+		},
+	}
+	wns.metrics = newMetrics(wns)
+	wns.logger = config.Logger
+	if wns.logger == nil {
+		wns.logger = NewTextLogger(os.Stderr)
+	}
+	wns.tracer = config.Tracer
+	wns.recorder = config.Recorder
+	wns.taps = newTapHub()
+	wns.bans = config.Bans
+	if wns.bans == nil {
+		wns.bans, _ = NewBanList("")
+	}
+	wns.verbosity = config.Verbosity
+	if wns.verbosity == nil {
+		wns.verbosity = NewVerbosity(LevelInfo)
+	}
+	if config.LowMemory {
+		// a zero ReadBufferSize makes gorilla reuse the 4KiB buffer of the
+		// hijacked http connection, messages are still read up to maxMessageSize.
+		wns.upgrader = websocket.Upgrader{WriteBufferPool: &sync.Pool{}, CheckOrigin: allowOrigin}
+		wns.pinger = newPinger(ctx)
+		if config.Netpoll {
+			poller, err := newNetpoll(wns.log)
+			if err != nil {
+				wns.log(LevelWarn, "netpoll disabled", F("error", err))
+			} else {
+				wns.poller = poller
+			}
+		}
+	}
+	return wns
+}
+
+// Metrics serves the Prometheus metrics of the server. It is meant for the
+// admin listener, not the public port.
+func (wns *WebsocketNetworkServer) Metrics() *Metrics {
+	return wns.metrics
+}
+
+// Verbosity controls the log output of the server at runtime.
+func (wns *WebsocketNetworkServer) Verbosity() *Verbosity {
+	return wns.verbosity
+}
+
+func (wns *WebsocketNetworkServer) log(level Level, msg string, fields ...Field) {
+	wns.logScoped(level, "", "", msg, fields...)
 }
 
-func NewWebsocketNetworkServer() *WebsocketNetworkServer {
-	return &WebsocketNetworkServer{
-		pool: make(map[string]*PeerPool),
+func (wns *WebsocketNetworkServer) logScoped(level Level, app, address string, msg string, fields ...Field) {
+	if wns == nil || !wns.verbosity.Enabled(level, app, address) {
+		return
 	}
+	wns.logger.Log(level, msg, fields...)
 }
 
+func (wns *WebsocketNetworkServer) pools() []*PeerPool {
+	wns.mu.Lock()
+	defer wns.mu.Unlock()
+	pools := make([]*PeerPool, 0, len(wns.pool))
+	for _, pp := range wns.pool {
+		pools = append(pools, pp)
+	}
+	return pools
+}
+
+// HandleUpgrade upgrades the request to a websocket connection and adds it to
+// the pool of the given app.
+func (wns *WebsocketNetworkServer) HandleUpgrade(w http.ResponseWriter, r *http.Request, config *AppConfig) {
+	if wns.ctx.Err() != nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if remote := wns.remoteAddr(r); remote != r.RemoteAddr {
+		forwarded := *r
+		forwarded.RemoteAddr = remote
+		r = &forwarded
+	}
+	if !config.originAllowed(r) {
+		wns.metrics.countReject(config.AppName, RejectOrigin)
+		wns.log(LevelWarn, "origin rejected", F("app", config.AppName), F("remote", r.RemoteAddr), F("origin", r.Header.Get("Origin")))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	u := upgrade{remote: r.RemoteAddr, ip: clientIP(r), ipLimit: wns.ipLimiter(config)}
+	if wns.banned(r, config.AppName, BanIP, u.ip) {
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+	if u.ipLimit != nil {
+		if ok, reason := u.ipLimit.acquire(u.ip); !ok {
+			wns.metrics.countReject(config.AppName, reason)
+			wns.log(LevelWarn, "connection limited", F("app", config.AppName), F("remote", r.RemoteAddr), F("reason", reason))
+			http.Error(w, "too many connections", http.StatusTooManyRequests)
+			return
+		}
+	}
+	// once added, the peer releases its IP when it is closed
+	added := false
+	defer func() {
+		if !added && u.ipLimit != nil {
+			u.ipLimit.release(u.ip)
+		}
+	}()
+	var header http.Header
+	claims, protocol, err := config.authenticate(r)
+	if err != nil {
+		wns.metrics.countReject(config.AppName, RejectAuth)
+		wns.log(LevelWarn, "authentication failed", F("app", config.AppName), F("remote", r.RemoteAddr), F("error", err))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if claims != nil && wns.banned(r, config.AppName, BanUser, claims.Subject) {
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+	u.claims = claims
+	if protocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {protocol}}
+	}
+	span := wns.tracer.Start(wns.traceParent(r), "upgrade", F("app", config.AppName), F("remote", r.RemoteAddr))
+	defer span.End()
+	hr := &hijackRecorder{ResponseWriter: w}
+	conn, err := wns.upgrader.Upgrade(hr, r, header)
+	if err != nil {
+		span.SetError(err)
+		wns.log(LevelDebug, "upgrade failed", F("app", config.AppName), F("remote", r.RemoteAddr), F("error", err))
+		return
+	}
+	var reader *bufio.Reader
+	if wns.poller != nil {
+		reader = hr.reader
+	}
+	u.trace = span.Context()
+	if sp := wns.addPeer(conn, reader, config, u); sp != nil {
+		added = true
+		span.SetAttributes(F("peer", sp.id))
+	}
+}
+
+// allowOrigin is the CheckOrigin of the upgrader, the origin was already
+// checked against the app config by HandleUpgrade.
+func allowOrigin(r *http.Request) bool {
+	return true
+}
+
+// traceParent is the client's span context if trace propagation is enabled.
+func (wns *WebsocketNetworkServer) traceParent(r *http.Request) SpanContext {
+	if wns.tracer == nil || !wns.config.TracePropagation {
+		return SpanContext{}
+	}
+	s := r.URL.Query().Get(TraceParam)
+	if s == "" {
+		return SpanContext{}
+	}
+	sc, err := ParseTraceparent(s)
+	if err != nil {
+		wns.log(LevelDebug, "invalid traceparent", F("remote", r.RemoteAddr), F("error", err))
+	}
+	return sc
+}
+
+// upgrade is what HandleUpgrade learned about a peer before adding it.
+type upgrade struct {
+	trace   SpanContext
+	claims  *Claims
+	remote  string
+	ip      string
+	ipLimit *ipLimiter
+}
+
+// OnConnection adds an already upgraded connection. The caller is
+// responsible for authenticating it, config.Auth and config.ClientCerts are
+// not checked.
 func (wns *WebsocketNetworkServer) OnConnection(socket *websocket.Conn, config *AppConfig) {
+	span := wns.tracer.Start(SpanContext{}, "upgrade", F("app", config.AppName), F("remote", socket.RemoteAddr().String()))
+	defer span.End()
+	if sp := wns.addPeer(socket, nil, config, upgrade{trace: span.Context()}); sp != nil {
+		span.SetAttributes(F("peer", sp.id))
+	}
+}
+
+// addPeer returns nil if the server is shutting down.
+func (wns *WebsocketNetworkServer) addPeer(socket *websocket.Conn, reader *bufio.Reader, config *AppConfig, u upgrade) *SignalingPeer {
+	wns.mu.Lock()
+	if wns.closing {
+		wns.mu.Unlock()
+		socket.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, string(DisconnectServerShutdown)),
+			time.Now().Add(writeWait))
+		socket.Close()
+		return nil
+	}
 	if _, ok := wns.pool[config.AppName]; !ok {
-		wns.pool[config.AppName] = NewPeerPool(config)
+		wns.pool[config.AppName] = NewPeerPool(wns, config)
+	}
+	pool := wns.pool[config.AppName]
+	wns.adding.Add(1)
+	wns.mu.Unlock()
+
+	sp := pool.add(socket, reader, u)
+	wns.adding.Done()
+	return sp
+}
+
+// Shutdown closes every peer with DisconnectServerShutdown and waits until
+// their goroutines have returned or ctx is done. Connections upgraded after
+// Shutdown started are closed right away.
+func (wns *WebsocketNetworkServer) Shutdown(ctx context.Context) error {
+	wns.Drain()
+	wns.mu.Lock()
+	wns.closing = true
+	wns.mu.Unlock()
+	wns.adding.Wait()
+	pools := wns.pools()
+	wns.cancel()
+
+	var peers []*SignalingPeer
+	for _, pp := range pools {
+		peers = append(peers, pp.peers()...)
+	}
+	for _, sp := range peers {
+		sp.Close(DisconnectServerShutdown)
+	}
+	if wns.poller != nil {
+		wns.poller.close()
+	}
+
+	for _, sp := range peers {
+		select {
+		case <-sp.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// hijackRecorder keeps the buffered reader of the hijacked connection. With a
+// zero ReadBufferSize gorilla reads from this buffer, so the netpoll reader can
+// tell whether frames are still buffered after the socket went quiet.
+type hijackRecorder struct {
+	http.ResponseWriter
+	reader *bufio.Reader
+}
+
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := hr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		hr.reader = brw.Reader
 	}
-	wns.pool[config.AppName].add(socket)
+	return conn, brw, err
 }
@@ -0,0 +1,369 @@
+package signalsrv
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var idlePeers = flag.Int("idle-peers", 100, "number of idle peers opened per BenchmarkIdlePeers iteration")
+
+var testModes = map[string]*ServerConfig{
+	"default":    {ReadBufferSize: 1024, WriteBufferSize: 1024},
+	"low-memory": {LowMemory: true},
+	"netpoll":    {LowMemory: true, Netpoll: true},
+}
+
+func newTestServer(t testing.TB, config *ServerConfig, app *AppConfig) (*WebsocketNetworkServer, string, func()) {
+	wns := NewWebsocketNetworkServer(config)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wns.HandleUpgrade(w, r, app)
+	}))
+	return wns, "ws" + strings.TrimPrefix(ts.URL, "http"), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := wns.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		ts.Close()
+	}
+}
+
+// testClient reads events in the background, so it answers pings unless its
+// ping handler is replaced.
+type testClient struct {
+	conn   *websocket.Conn
+	events chan *NetworkEvent
+	err    chan error
+	mute   int32
+}
+
+func dialTestClient(t testing.TB, url string) *testClient {
+	return dialTestClientWith(t, websocket.DefaultDialer, url)
+}
+
+func dialTestClientWith(t testing.TB, dialer *websocket.Dialer, url string) *testClient {
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{
+		conn:   conn,
+		events: make(chan *NetworkEvent, 64),
+		err:    make(chan error, 1),
+	}
+	conn.SetPingHandler(func(data string) error {
+		if atomic.LoadInt32(&c.mute) != 0 {
+			return nil
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				c.err <- err
+				close(c.events)
+				return
+			}
+			evt, err := FromByteArray(msg)
+			if err != nil {
+				c.err <- err
+				close(c.events)
+				return
+			}
+			c.events <- evt
+		}
+	}()
+	return c
+}
+
+func (c *testClient) send(t testing.TB, typ int, id int16, data string) {
+	evt := NewNetworkEvent(typ, NewConnectionId(id), &NetEventData{Type: NetEventDataTypeUTF16String, StringData: &data})
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, evt.ToByteArray()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testClient) expect(t testing.TB, typ int) *NetworkEvent {
+	t.Helper()
+	select {
+	case evt, ok := <-c.events:
+		if !ok {
+			t.Fatalf("expected event type %d got: %v", typ, <-c.err)
+		}
+		if evt.Type != typ {
+			t.Fatalf("expected event type %d got: %d", typ, evt.Type)
+		}
+		return evt
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected event type %d got: timeout", typ)
+	}
+	return nil
+}
+
+func (c *testClient) expectNone(t testing.TB, d time.Duration) {
+	t.Helper()
+	select {
+	case evt, ok := <-c.events:
+		if ok {
+			t.Errorf("expected no event got: %s", evt.String())
+		}
+	case <-time.After(d):
+	}
+}
+
+func (c *testClient) expectClose(t testing.TB, code int) {
+	t.Helper()
+	for range c.events {
+	}
+	err := <-c.err
+	if !websocket.IsCloseError(err, code) {
+		t.Errorf("expected close code %d got: %v", code, err)
+	}
+}
+
+// peerGoroutines lists the goroutines still running server code, in the
+// spirit of go.uber.org/goleak.
+func peerGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var leaked []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "signalsrv.(*SignalingPeer)") ||
+			strings.Contains(g, "signalsrv.(*pinger)") ||
+			strings.Contains(g, "signalsrv.(*netpoll)") {
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
+
+func testPool(wns *WebsocketNetworkServer, app string) *PeerPool {
+	wns.mu.Lock()
+	defer wns.mu.Unlock()
+	return wns.pool[app]
+}
+
+// testPeers lists the peers of app listening on an address with prefix.
+func testPeers(wns *WebsocketNetworkServer, app, prefix string) []PeerInfo {
+	_, infos := testPool(wns, app).peerInfos(prefix, 0, adminMaxLimit)
+	return infos
+}
+
+func verifyNoLeaks(t testing.TB) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		leaked := peerGoroutines()
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked goroutines:\n%s", strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerInitialized(t *testing.T) {
+	for name, config := range testModes {
+		t.Run(name, func(t *testing.T) {
+			_, url, closeServer := newTestServer(t, config, &AppConfig{Path: "/", AppName: "Test"})
+			defer verifyNoLeaks(t)
+			defer closeServer()
+
+			c := dialTestClient(t, url)
+			defer c.conn.Close()
+
+			if err := c.conn.WriteControl(websocket.PingMessage, []byte("hi"), time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			c.send(t, NetEventTypeServerInitialized, -1, "room")
+			c.expect(t, NetEventTypeServerInitialized)
+
+			// restarting the server closes the old address first
+			c.send(t, NetEventTypeServerInitialized, -1, "room")
+			c.expect(t, NetEventTypeServerClosed)
+			c.expect(t, NetEventTypeServerInitialized)
+		})
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	defer func(ping, pong time.Duration) {
+		pingPeriod, pongWait = ping, pong
+	}(pingPeriod, pongWait)
+	pingPeriod, pongWait = 50*time.Millisecond, 300*time.Millisecond
+
+	paths := map[DisconnectReason]func(t *testing.T, wns *WebsocketNetworkServer, sp *SignalingPeer, c *testClient){
+		DisconnectClientClosed: func(t *testing.T, wns *WebsocketNetworkServer, sp *SignalingPeer, c *testClient) {
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			c.conn.Close()
+		},
+		DisconnectPingTimeout: func(t *testing.T, wns *WebsocketNetworkServer, sp *SignalingPeer, c *testClient) {
+			atomic.StoreInt32(&c.mute, 1)
+		},
+		DisconnectWriteError: func(t *testing.T, wns *WebsocketNetworkServer, sp *SignalingPeer, c *testClient) {
+			sp.socket.UnderlyingConn().(*net.TCPConn).CloseWrite()
+			c.send(t, NetEventTypeServerInitialized, -1, "other")
+		},
+		DisconnectServerShutdown: func(t *testing.T, wns *WebsocketNetworkServer, sp *SignalingPeer, c *testClient) {
+			if err := wns.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			c.expectClose(t, websocket.CloseGoingAway)
+		},
+	}
+
+	for mode, config := range testModes {
+		for reason, disconnect := range paths {
+			t.Run(mode+"/"+string(reason), func(t *testing.T) {
+				wns, url, closeServer := newTestServer(t, config, &AppConfig{Path: "/", AppName: "Test"})
+				defer verifyNoLeaks(t)
+				defer closeServer()
+
+				listener := dialTestClient(t, url)
+				defer listener.conn.Close()
+				listener.send(t, NetEventTypeServerInitialized, -1, "room")
+				listener.expect(t, NetEventTypeServerInitialized)
+				sp := testPool(wns, "Test").peers()[0]
+
+				connector := dialTestClient(t, url)
+				defer connector.conn.Close()
+				connector.send(t, NetEventTypeNewConnection, 1, "room")
+				connector.expect(t, NetEventTypeNewConnection)
+				listener.expect(t, NetEventTypeNewConnection)
+
+				disconnect(t, wns, sp, listener)
+
+				select {
+				case <-sp.Done():
+				case <-time.After(2 * time.Second):
+					t.Fatal("peer was not closed")
+				}
+				if want, got := reason, sp.reason; want != got {
+					t.Errorf("expected reason %s got: %s", want, got)
+				}
+				if reason == DisconnectServerShutdown {
+					connector.expectClose(t, websocket.CloseGoingAway)
+					return
+				}
+
+				// the connector is told exactly once
+				if want, got := int16(1), connector.expect(t, NetEventTypeDisconnected).ConnectionId.ID; want != got {
+					t.Errorf("expected connectionId %d got: %d", want, got)
+				}
+				connector.expectNone(t, 100*time.Millisecond)
+				if want, got := 1, len(testPool(wns, "Test").peers()); want != got {
+					t.Errorf("expected %d peers got: %d", want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestQueueFullClosesOnce(t *testing.T) {
+	wns, url, closeServer := newTestServer(t, nil, &AppConfig{Path: "/", AppName: "Test"})
+	defer verifyNoLeaks(t)
+	defer closeServer()
+
+	c := dialTestClient(t, url)
+	defer c.conn.Close()
+	c.send(t, NetEventTypeServerInitialized, -1, "room")
+	c.expect(t, NetEventTypeServerInitialized)
+	sp := testPool(wns, "Test").peers()[0]
+
+	pool := sp.connectionPool
+	pool.mu.Lock()
+	routines := runtime.NumGoroutine()
+	for i := 0; i < 10000; i++ {
+		sp.sendToClient(NewNetworkEvent(NetEventTypeLog, INVALIDConnectionId, &NetEventData{Type: NetEventDataTypeNull}))
+	}
+	// the closer waits for the pool lock, the pumps may have stopped already
+	if got := runtime.NumGoroutine() - routines; got > 1 {
+		t.Errorf("expected at most one closer got: %d goroutines", got)
+	}
+	pool.mu.Unlock()
+
+	select {
+	case <-sp.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer was not closed")
+	}
+	if want, got := DisconnectQueueFull, sp.reason; want != got {
+		t.Errorf("expected reason %s got: %s", want, got)
+	}
+}
+
+func benchmarkIdlePeers(b *testing.B, config *ServerConfig) {
+	var wg sync.WaitGroup
+	wns := NewWebsocketNetworkServer(config)
+	defer wns.Shutdown(context.Background())
+	app := &AppConfig{Path: "/", AppName: "Bench"}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wns.HandleUpgrade(w, r, app)
+		wg.Done()
+	}))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	dialer := websocket.Dialer{ReadBufferSize: 256, WriteBufferSize: 256}
+
+	var memory, goroutines float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		routines := runtime.NumGoroutine()
+
+		conns := make([]*websocket.Conn, 0, *idlePeers)
+		wg.Add(*idlePeers)
+		for j := 0; j < *idlePeers; j++ {
+			conn, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		wg.Wait()
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		memory += float64(after.HeapInuse+after.StackInuse) - float64(before.HeapInuse+before.StackInuse)
+		goroutines += float64(runtime.NumGoroutine() - routines)
+
+		b.StopTimer()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		b.StartTimer()
+	}
+
+	// the numbers include the client side of each connection, which has no
+	// goroutines and uses 256 byte buffers.
+	peers := float64(b.N * *idlePeers)
+	b.ReportMetric(memory/peers, "B/peer")
+	b.ReportMetric(goroutines/peers, "goroutines/peer")
+}
+
+func BenchmarkIdlePeers(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkIdlePeers(b, &ServerConfig{ReadBufferSize: 1048576, WriteBufferSize: 1048576})
+	})
+	b.Run("low-memory", func(b *testing.B) {
+		benchmarkIdlePeers(b, &ServerConfig{LowMemory: true})
+	})
+	b.Run("netpoll", func(b *testing.B) {
+		benchmarkIdlePeers(b, &ServerConfig{LowMemory: true, Netpoll: true})
+	})
+}